@@ -1,23 +1,108 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 )
 
-// writeSourceURL writes the URL of a source to the response writer
+// isHTTPSource reports whether a source is a HTTP URL
+func isHTTPSource(src string) bool {
+	return strings.HasPrefix(strings.ToLower(src), "http")
+}
+
+// isRTSPSource reports whether a source is a RTSP URL
+func isRTSPSource(src string) bool {
+	return strings.HasPrefix(strings.ToLower(src), "rtsp")
+}
+
+// isFileSource reports whether a source is a local TS file
+func isFileSource(src string) bool {
+	return strings.HasPrefix(src, "file:")
+}
+
+// isUnicastSource reports whether a source is pulled from an upstream server
+// instead of joining a multicast group
+func isUnicastSource(src string) bool {
+	return isHTTPSource(src) || isRTSPSource(src)
+}
+
+// findChannelSources returns the sources of the channel with the name, the
+// result is a copy and is safe to use without lock.
+func findChannelSources(name string) ([]string, bool) {
+	var (
+		sources []string
+		found   bool
+	)
+
+	channelGroupForEach(func(group *ChannelGroup) {
+		if found {
+			return
+		}
+		for _, ch := range group.Channels {
+			if ch.Name == name {
+				sources = append(sources, ch.Sources...)
+				found = true
+				return
+			}
+		}
+	})
+
+	return sources, found
+}
+
+// isChannelSource reports whether a source is configured in any channel,
+// only these unicast sources are relayed, so that the server is not an open
+// proxy.
+func isChannelSource(src string) bool {
+	found := false
+	channelGroupForEach(func(group *ChannelGroup) {
+		for _, ch := range group.Channels {
+			if slices.Contains(ch.Sources, src) {
+				found = true
+				return
+			}
+		}
+	})
+	return found
+}
+
+// writeSourceURL writes the URL of a source to the response writer, HTTP and
+// RTSP sources are also relayed, so that the upstream is shared among clients,
+// except HTTP sources which are not MPEG TS streams, they are written as is.
+// The source is escaped, e.g. the brackets of IPv6 addresses are not allowed
+// in the path.
 func writeSourceURL(w http.ResponseWriter, svrAddr, src string) {
-	if strings.HasPrefix(strings.ToLower(src), "http") {
+	if isNonTSSource(src) {
 		fmt.Fprintln(w, src)
-	} else {
-		fmt.Fprintf(w, "http://%s/iptv/relay/%s\n", svrAddr, src)
+		return
 	}
+	fmt.Fprintf(w, "http://%s/iptv/relay/%s\n", svrAddr, url.PathEscape(src))
+}
+
+// playlistServerAddr returns the server address used in the playlist URLs,
+// it is the configured server address, or the host requested by the client
+// if the IP address of the configured one is unspecified.
+func playlistServerAddr(r *http.Request) string {
+	addr := getConfig().ServerAddr
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); (host == "" || (ip != nil && ip.IsUnspecified())) && r.Host != "" {
+		return r.Host
+	}
+	return addr
 }
 
 // listChannelsInM3U8 lists all IPTV channels in M3U8 format
-func listChannelsInM3U8(w http.ResponseWriter, _ *http.Request) {
-	cfg := getConfig()
+func listChannelsInM3U8(w http.ResponseWriter, r *http.Request) {
+	svrAddr := playlistServerAddr(r)
 
 	w.Header().Set("Content-Type", "application/x-mpegURL;charset=UTF-8")
 
@@ -44,15 +129,24 @@ func listChannelsInM3U8(w http.ResponseWriter, _ *http.Request) {
 				dn)
 			fmt.Fprintln(w)
 
-			writeSourceURL(w, cfg.ServerAddr, ch.Sources[0])
+			// use the channel relay if there are more than one sources, so
+			// that the client could switch to the next source automatically
+			if len(ch.Sources) > 1 {
+				fmt.Fprintf(w,
+					"http://%s/iptv/channel/%s\n",
+					svrAddr,
+					url.PathEscape(ch.Name))
+			} else {
+				writeSourceURL(w, svrAddr, ch.Sources[0])
+			}
 			id++
 		}
 	})
 }
 
 // listChannelsInText lists all IPTV channels in text format, DIYP style
-func listChannelsInText(w http.ResponseWriter, _ *http.Request) {
-	cfg := getConfig()
+func listChannelsInText(w http.ResponseWriter, r *http.Request) {
+	svrAddr := playlistServerAddr(r)
 
 	w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
 
@@ -66,7 +160,7 @@ func listChannelsInText(w http.ResponseWriter, _ *http.Request) {
 
 			for _, src := range ch.Sources {
 				fmt.Fprint(w, ch.Name, ",")
-				writeSourceURL(w, cfg.ServerAddr, src)
+				writeSourceURL(w, svrAddr, src)
 			}
 		}
 
@@ -85,3 +179,88 @@ func iptvListChannels(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "supported format", http.StatusBadRequest)
 	}
 }
+
+// iptvChannelRelay relays an IPTV channel to HTTP, it begins with the first
+// source of the channel, and switches to the next source if the current one
+// fails, without dropping the client's HTTP connection.
+func iptvChannelRelay(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	sources, found := findChannelSources(name)
+	if !found {
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+
+	sel, err := parseProgramSelector(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/MP2T")
+
+	// 'failed' is the number of consecutive sources that failed without
+	// delivering any data, we give up after all sources failed this way.
+	total, failed := int64(0), 0
+	var limitErr error
+	for i := 0; failed < len(sources); i = (i + 1) % len(sources) {
+		src := sources[i]
+
+		// a source which is not a MPEG TS stream could not be spliced with
+		// others, so the client is redirected to it if nothing is sent yet
+		if isNonTSSource(src) {
+			if total == 0 {
+				w.Header().Del("Content-Type")
+				http.Redirect(w, r, src, http.StatusFound)
+				return
+			}
+			failed++
+			continue
+		}
+
+		mc, created, err := mcastJoin(src)
+		var n int64
+		mcClosed := false
+		if err == nil {
+			n, mcClosed, err = relayToClient(mc, created, sel, w, r)
+		}
+		if err != nil {
+			if errors.Is(err, errLimitExceeded) {
+				limitErr = err
+			}
+			failed++
+			continue
+		}
+		if !mcClosed {
+			// the client is gone or closed by the admin
+			return
+		}
+		if n == 0 && total == 0 && isNonTSSource(src) {
+			w.Header().Del("Content-Type")
+			http.Redirect(w, r, src, http.StatusFound)
+			return
+		}
+
+		total += n
+		if n > 0 {
+			failed = 0
+		}
+		failed++
+
+		slog.Warn(
+			"channel source failed, switching to the next source",
+			slog.String("channel", name),
+			slog.String("source", src),
+		)
+	}
+
+	slog.Error("all sources of the channel failed", slog.String("channel", name))
+	if total > 0 {
+		return
+	}
+	if limitErr != nil {
+		http.Error(w, limitErr.Error(), http.StatusServiceUnavailable)
+	} else {
+		http.Error(w, "no available source", http.StatusServiceUnavailable)
+	}
+}
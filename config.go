@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -26,7 +28,10 @@ type Channel struct {
 	Hide bool `json:"hide,omitempty"`
 
 	// sources of the channel, if a source does NOT begin with 'http',
-	// MyIPTV regards it as a multicast address.
+	// 'rtsp' or 'file:', MyIPTV regards it as a multicast address, which
+	// could be 'group:port', or 'source@group:port' for source-specific
+	// multicast. A 'file:' source is a TS file in 'FileSourceDir' which is
+	// played in a loop, such as 'file:family.ts'.
 	Sources []string `json:"sources,omitempty"`
 }
 
@@ -41,7 +46,11 @@ type ChannelGroup struct {
 
 // Config defines MyIPTV configuration
 type Config struct {
-	// HTTP server address, including IP address and port
+	// HTTP server address, including IP address and port, an IPv6 address
+	// must be enclosed in square brackets, such as '[2001:db8::1]:7709'. If
+	// the IP address is unspecified ('0.0.0.0' or '[::]', the latter also
+	// accepts IPv4 connections), the host in the playlist URLs is the one
+	// used by the client to request the playlist.
 	ServerAddr string `json:"serverAddr,omitempty"`
 
 	// EPG URL, default is 'http://epg.51zmt.top:8000/e.xml'
@@ -54,15 +63,135 @@ type Config struct {
 	// default is 2048
 	McastPacketSize int `json:"mcastPacketSize,omitempty"`
 
-	// WriteBufferSize is the buffer size, which is used to buffer the
-	// multicast packets before writing to clients, default is 131072.
-	// Note changing this value may not take effect immediately, beacuse
-	// we are using sync.Pool to manage the buffers.
+	// McastBatchSize is the max number of multicast packets received with
+	// one system call, default is 16. It only takes effect on Linux, where
+	// the packets are received by recvmmsg, 1 disables the batching.
+	McastBatchSize int `json:"mcastBatchSize,omitempty"`
+
+	// McastRecvBuffer is the size of the receive buffer of the multicast
+	// sockets, its unit is byte, default is 1048576, a negative value keeps
+	// the system default. A large buffer prevents packet loss when the
+	// program cannot read the packets in time. On Linux, the size is limited
+	// by 'net.core.rmem_max' unless the program has CAP_NET_ADMIN.
+	McastRecvBuffer int `json:"mcastRecvBuffer,omitempty"`
+
+	// WriteBufferSize is the size of the chunks in which the received data
+	// is delivered to clients, default is 131072. A smaller value reduces
+	// the latency, but increases the number of writes to clients.
 	WriteBufferSize int `json:"writeBufferSize,omitempty"`
 
 	// ReadTimeout is the timeout for read multicast packets to fill the write
 	// buffer, its unit is millisecond, default is 1000
 	ReadTimeout int `json:"readTimeout,omitempty"`
+
+	// SourceTimeout is the timeout for receiving data from a HTTP or RTSP
+	// source, its unit is millisecond, default is 5000
+	SourceTimeout int `json:"sourceTimeout,omitempty"`
+
+	// RTSPTransport is the transport of RTSP sources, 'tcp' means the RTP
+	// packets are interleaved in the RTSP connection, 'udp' means they are
+	// sent to a UDP port, default is 'tcp'
+	RTSPTransport string `json:"rtspTransport,omitempty"`
+
+	// FileSourceDir is the directory of the TS files of 'file:' sources,
+	// default is 'file' in the working directory
+	FileSourceDir string `json:"fileSourceDir,omitempty"`
+
+	// RTPReorderWindow is the max number of RTP packets to hold for
+	// reordering the packets which arrive out of order, default is 32
+	RTPReorderWindow int `json:"rtpReorderWindow,omitempty"`
+
+	// RelayLinger is the time to keep a relay connection after its last
+	// client leaves, so that a client reconnecting soon (many players do
+	// this on channel change or buffer reset) could reuse it without joining
+	// the multicast group again. Its unit is second, default is 5, a
+	// negative value disables it.
+	RelayLinger int `json:"relayLinger,omitempty"`
+
+	// MaxGroups is the max number of relay connections receiving from the
+	// network (multicast groups, HTTP and RTSP sources) at the same time,
+	// 0 means no limit. Requests which need a new connection are rejected
+	// with 503 once the limit is reached, lingering connections are closed
+	// first to make room for new ones.
+	MaxGroups int `json:"maxGroups,omitempty"`
+
+	// MaxBandwidth is the max total inbound bitrate of the relay connections
+	// receiving from the network, its unit is kbps, 0 means no limit. The
+	// bitrate of a new connection is estimated from the last time the
+	// source was relayed, or the average of the active connections.
+	MaxBandwidth int `json:"maxBandwidth,omitempty"`
+
+	// MaxGroupClients is the max number of clients of a relay connection,
+	// including recordings and HLS sessions, 0 means no limit
+	MaxGroupClients int `json:"maxGroupClients,omitempty"`
+
+	// ClientWriteTimeout is the timeout of a write to a relay client, its
+	// unit is millisecond, default is 10000, a negative value disables it.
+	// A client which does not read the data in time is regarded as stalled
+	// and is disconnected.
+	ClientWriteTimeout int `json:"clientWriteTimeout,omitempty"`
+
+	// StallPolicy is the policy for a relay client which skips data for
+	// 'StallDrops' times in a row because it is too slow. 'drop' keeps the
+	// client and continues to skip data, 'disconnect' disconnects it, and
+	// 'downgrade' only sends it the key frames and other streams like the
+	// audio. Default is 'drop'.
+	StallPolicy string `json:"stallPolicy,omitempty"`
+
+	// StallDrops is the number of consecutive skips before 'StallPolicy' is
+	// applied, the count is reset when the client reads a full relay buffer
+	// without skipping, default is 3
+	StallDrops int `json:"stallDrops,omitempty"`
+
+	// RelayBufferSize is the size of the ring buffer of a relay connection,
+	// which is shared by all clients of the connection, its unit is byte,
+	// default is 8388608. A client skips to the latest key frame if it is
+	// too slow and the data it has not read is overwritten. It should be
+	// larger than 'GOPCacheSize', and must be at least 4 times the larger
+	// one of 'WriteBufferSize' and 'McastPacketSize'.
+	RelayBufferSize int `json:"relayBufferSize,omitempty"`
+
+	// GOPCacheSize is the max size of the GOP cache of a multicast connection,
+	// new clients begin with the packets since the latest key frame in the
+	// ring buffer so that they can begin playing immediately, if the size of
+	// these packets does not exceed this value. Its unit is byte, default is
+	// 4194304
+	GOPCacheSize int `json:"gopCacheSize,omitempty"`
+
+	// HealthCheckInterval is the interval of the background source health
+	// check, its unit is minute, default is 0, which disables the health
+	// check. Note the check joins every multicast source one by one.
+	HealthCheckInterval int `json:"healthCheckInterval,omitempty"`
+
+	// HealthCheckDuration is the duration to receive data from a source in
+	// the health check, its unit is second, default is 3
+	HealthCheckDuration int `json:"healthCheckDuration,omitempty"`
+
+	// RecordingDir is the directory to save recordings, default is
+	// 'recordings' in the working directory
+	RecordingDir string `json:"recordingDir,omitempty"`
+
+	// TimeshiftAddrs is the list of multicast addresses which are buffered
+	// for timeshift, they are received all the time even if there's no
+	// client. Changes take effect after the program is restarted.
+	TimeshiftAddrs []string `json:"timeshiftAddrs,omitempty"`
+
+	// TimeshiftDuration is the duration of the timeshift buffers, its unit
+	// is minute, default is 60
+	TimeshiftDuration int `json:"timeshiftDuration,omitempty"`
+
+	// TimeshiftDir is the directory to save timeshift buffers, default is
+	// 'timeshift' in the working directory, use a directory in tmpfs to keep
+	// the buffers in memory
+	TimeshiftDir string `json:"timeshiftDir,omitempty"`
+
+	// HLSSegmentDuration is the target duration of HLS segments, its unit is
+	// second, default is 2
+	HLSSegmentDuration int `json:"hlsSegmentDuration,omitempty"`
+
+	// HLSPlaylistSize is the number of segments in a HLS live playlist,
+	// default is 6
+	HLSPlaylistSize int `json:"hlsPlaylistSize,omitempty"`
 }
 
 // Clourflare DDNS configuration
@@ -94,10 +223,17 @@ type DDNSConfig struct {
 
 // findBestIP finds the best IP address from the http server
 func findBestIP(m map[string][]string) string {
-	first := ""
+	first, first6 := "", ""
 	for _, ips := range m {
 		for _, ip := range ips {
-			// we use the first IP by default
+			// we use the first IPv4 address by default, and the first
+			// IPv6 address if there's no IPv4 address
+			if strings.Contains(ip, ":") {
+				if first6 == "" {
+					first6 = ip
+				}
+				continue
+			}
 			if first == "" {
 				first = ip
 			}
@@ -107,9 +243,22 @@ func findBestIP(m map[string][]string) string {
 			}
 		}
 	}
+	if first == "" {
+		return first6
+	}
 	return first
 }
 
+// relayBufferMinChunks is the min number of chunks the relay buffer holds
+const relayBufferMinChunks = 4
+
+// minRelayBufferSize returns the min size of the relay buffer, it holds a few
+// chunks, and a single write to it, which is a multicast packet or a read
+// from an upstream, never wraps over itself.
+func (cfg *Config) minRelayBufferSize() int {
+	return relayBufferMinChunks * max(cfg.WriteBufferSize, cfg.McastPacketSize, upstreamReadSize)
+}
+
 // populateDefault populates default values to the configuration.
 func (cfg *Config) populateDefault() {
 	if cfg.EPGURL == "" {
@@ -120,6 +269,14 @@ func (cfg *Config) populateDefault() {
 		cfg.McastPacketSize = 2048
 	}
 
+	if cfg.McastBatchSize <= 0 {
+		cfg.McastBatchSize = 16
+	}
+
+	if cfg.McastRecvBuffer == 0 {
+		cfg.McastRecvBuffer = 1048576
+	}
+
 	if cfg.WriteBufferSize <= 0 {
 		cfg.WriteBufferSize = 131072
 	}
@@ -128,6 +285,80 @@ func (cfg *Config) populateDefault() {
 		cfg.ReadTimeout = 1000
 	}
 
+	if cfg.SourceTimeout <= 0 {
+		cfg.SourceTimeout = 5000
+	}
+
+	if cfg.RTSPTransport != "udp" {
+		cfg.RTSPTransport = "tcp"
+	}
+
+	if cfg.FileSourceDir == "" {
+		cfg.FileSourceDir = "file"
+	}
+
+	if cfg.RTPReorderWindow <= 0 {
+		cfg.RTPReorderWindow = 32
+	}
+
+	if cfg.RelayLinger == 0 {
+		cfg.RelayLinger = 5
+	}
+
+	if cfg.ClientWriteTimeout == 0 {
+		cfg.ClientWriteTimeout = 10000
+	}
+
+	switch cfg.StallPolicy {
+	case stallPolicyDisconnect, stallPolicyDowngrade:
+	default:
+		cfg.StallPolicy = stallPolicyDrop
+	}
+
+	if cfg.StallDrops <= 0 {
+		cfg.StallDrops = 3
+	}
+
+	if cfg.RelayBufferSize <= 0 {
+		cfg.RelayBufferSize = 8388608
+	}
+	if size := cfg.minRelayBufferSize(); cfg.RelayBufferSize < size {
+		slog.Warn(
+			"relay buffer size is too small, enlarged",
+			slog.Int("relayBufferSize", cfg.RelayBufferSize),
+			slog.Int("newSize", size),
+		)
+		cfg.RelayBufferSize = size
+	}
+
+	if cfg.GOPCacheSize <= 0 {
+		cfg.GOPCacheSize = 4194304
+	}
+
+	if cfg.HealthCheckDuration <= 0 {
+		cfg.HealthCheckDuration = 3
+	}
+
+	if cfg.RecordingDir == "" {
+		cfg.RecordingDir = "recordings"
+	}
+
+	if cfg.TimeshiftDuration <= 0 {
+		cfg.TimeshiftDuration = 60
+	}
+
+	if cfg.TimeshiftDir == "" {
+		cfg.TimeshiftDir = "timeshift"
+	}
+
+	if cfg.HLSSegmentDuration <= 0 {
+		cfg.HLSSegmentDuration = 2
+	}
+
+	if cfg.HLSPlaylistSize <= 0 {
+		cfg.HLSPlaylistSize = 6
+	}
+
 	if cfg.ServerAddr != "" && cfg.McastIface != "" {
 		return
 	}
@@ -150,7 +381,7 @@ func (cfg *Config) populateDefault() {
 
 	if len(m) == 1 {
 		if cfg.ServerAddr == "" {
-			cfg.ServerAddr = findBestIP(m) + ":7709"
+			cfg.ServerAddr = net.JoinHostPort(findBestIP(m), "7709")
 		} else if cfg.McastIface == "" {
 			for iface := range m {
 				cfg.McastIface = iface
@@ -167,16 +398,17 @@ func (cfg *Config) populateDefault() {
 
 	// try configure the http server address
 	if cfg.ServerAddr == "" {
-		cfg.ServerAddr = findBestIP(m) + ":7709"
+		cfg.ServerAddr = net.JoinHostPort(findBestIP(m), "7709")
 	}
 
 	// try configure the multicast interface
 	if cfg.McastIface == "" {
+		host, _, _ := net.SplitHostPort(cfg.ServerAddr)
 	IFACE_LOOP:
 		for iface, ips := range m {
 			for _, ip := range ips {
 				// remove the interface if it has the http server address
-				if strings.HasPrefix(cfg.ServerAddr, ip+":") {
+				if ip == host {
 					delete(m, iface)
 					break IFACE_LOOP
 				}
@@ -226,6 +458,7 @@ type allConfig struct {
 	DDNS          *DDNSConfig    `json:"ddns,omitempty"`
 	Config        *Config        `json:"config"`
 	ChannelGroups []ChannelGroup `json:"channelGroups,omitempty"`
+	Outputs       []Output       `json:"outputs,omitempty"`
 }
 
 // loadConfig loads configuration from 'myiptv.json', it ignores all errors,
@@ -272,15 +505,18 @@ func loadConfig() {
 
 	// this function is only called at program startup, no need to lock
 	channelGroups = allCfg.ChannelGroups
+	outputs = allCfg.Outputs
 	ddnsConfig = allCfg.DDNS
 }
 
-// saveConfig saves the configuration to 'configPath'.
+// saveConfig saves the configuration to 'configPath', the outputs are saved
+// too, the caller must hold 'configLock'.
 func saveConfig(cfg *Config, chGrps []ChannelGroup) error {
 	allCfg := allConfig{
 		DDNS:          ddnsConfig,
 		Config:        cfg,
 		ChannelGroups: chGrps,
+		Outputs:       outputs,
 	}
 
 	data, err := json.Marshal(&allCfg)
@@ -323,6 +559,22 @@ func apiUpdateConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, addr := range cfg.TimeshiftAddrs {
+		if _, _, err := parseMcastAddr(addr); err != nil {
+			http.Error(w, fmt.Sprintf("invalid timeshift address %q: %s", addr, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// the populated default values are not saved, so they are populated to
+	// a copy
+	populated := cfg
+	populated.populateDefault()
+	if size := populated.minRelayBufferSize(); cfg.RelayBufferSize > 0 && cfg.RelayBufferSize < size {
+		http.Error(w, fmt.Sprintf("relay buffer size must be at least %d", size), http.StatusBadRequest)
+		return
+	}
+
 	configLock.Lock()
 	defer configLock.Unlock()
 
@@ -330,11 +582,7 @@ func apiUpdateConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	// call populateDefault after saving the configuration, because we don't
-	// want to save the populated default values.
-	cfg.populateDefault()
-	config.Store(&cfg)
+	config.Store(&populated)
 }
 
 // channelGroupForEach iterates all channel groups and calls the function.
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPopulateDefaultRelayBufferSize(t *testing.T) {
+	cfg := &Config{
+		ServerAddr:      "127.0.0.1:7709",
+		McastIface:      "lo",
+		WriteBufferSize: 1048576,
+		RelayBufferSize: 1048576,
+	}
+	cfg.populateDefault()
+	if cfg.RelayBufferSize != relayBufferMinChunks*1048576 {
+		t.Fatalf("relay buffer size is not enlarged: %d", cfg.RelayBufferSize)
+	}
+}
+
+func TestUpdateConfigRelayBufferSize(t *testing.T) {
+	old := configPath
+	configPath = filepath.Join(t.TempDir(), "myiptv.json")
+	oldCfg := config.Load()
+	t.Cleanup(func() {
+		configPath = old
+		if oldCfg != nil {
+			config.Store(oldCfg)
+		}
+	})
+
+	update := func(body string) int {
+		r := httptest.NewRequest(http.MethodPut, "/api/config", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		apiUpdateConfig(w, r)
+		return w.Code
+	}
+
+	body := `{"serverAddr": "127.0.0.1:7709", "mcastIface": "lo", "writeBufferSize": 131072, "relayBufferSize": 262144}`
+	if code := update(body); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", code)
+	}
+	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+		t.Fatal("rejected configuration is saved")
+	}
+
+	body = strings.Replace(body, "262144", "524288", 1)
+	if code := update(body); code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", code)
+	}
+	if size := getConfig().RelayBufferSize; size != 524288 {
+		t.Fatalf("unexpected relay buffer size: %d", size)
+	}
+}
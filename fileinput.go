@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileInput plays a local TS file in a loop, the packets are sent at the pace
+// of the PCR, so that the clients receive it just like a live stream.
+type fileInput struct {
+	f *os.File
+}
+
+// newFileInput opens the file of a 'file:' source, the file name must be a
+// local path in 'FileSourceDir'
+func newFileInput(addr string) (*fileInput, error) {
+	name := strings.TrimPrefix(addr, "file:")
+	if !filepath.IsLocal(name) {
+		slog.Error("invalid file source", slog.String("address", addr))
+		return nil, errInvalidMcastAddr
+	}
+
+	f, err := os.Open(filepath.Join(getConfig().FileSourceDir, name))
+	if err != nil {
+		slog.Error(
+			"failed to open file source",
+			slog.String("address", addr),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	return &fileInput{f: f}, nil
+}
+
+func (in *fileInput) receive(mc *mcastConn) {
+	r := bufio.NewReaderSize(in.f, 64*1024)
+	buf := make([]byte, 0, outputPacketSize)
+
+	// flush writes the buffered packets to the connection, it returns false
+	// if all clients are gone
+	flush := func() bool {
+		if len(buf) == 0 {
+			return true
+		}
+		alive := mc.write(buf)
+		buf = buf[:0]
+		return alive
+	}
+
+	pacer := newPCRPacer()
+	discontinue := false
+
+	for mc.ctx.Err() == nil {
+		pkt, err := r.Peek(tsPacketSize)
+		if errors.Is(err, io.EOF) {
+			if !pacer.hasPCR() {
+				slog.Error("no PCR in file source", slog.String("address", mc.addr))
+				return
+			}
+			if !flush() {
+				return
+			}
+			_, err = in.f.Seek(0, io.SeekStart)
+			r.Reset(in.f)
+
+			// the PCR goes backwards, mark it with the discontinuity
+			// indicator so that the clients won't regard it as an error
+			pacer.reset()
+			discontinue = true
+		}
+		if err != nil {
+			slog.Error(
+				"failed to read file source",
+				slog.String("address", mc.addr),
+				slog.String("error", err.Error()),
+			)
+			return
+		}
+		if len(pkt) < tsPacketSize {
+			continue
+		}
+
+		if pkt[0] != tsSyncByte {
+			r.Discard(1)
+			continue
+		}
+
+		mark := false
+		if wait, ok := pacer.delay(pkt); ok {
+			// the packets before the PCR are sent before waiting for it
+			if !flush() {
+				return
+			}
+
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-mc.ctx.Done():
+					return
+				}
+			}
+
+			mark, discontinue = discontinue, false
+		}
+
+		buf = append(buf, pkt...)
+		r.Discard(tsPacketSize)
+		if mark {
+			buf[len(buf)-tsPacketSize+5] |= 0x80
+		}
+		if len(buf) == cap(buf) && !flush() {
+			return
+		}
+	}
+}
+
+func (in *fileInput) close() {
+	in.f.Close()
+}
@@ -1,3 +1,7 @@
 module github.com/localvar/myiptv
 
 go 1.22.0
+
+require golang.org/x/net v0.35.0
+
+require golang.org/x/sys v0.30.0 // indirect
@@ -0,0 +1,72 @@
+package main
+
+// tsGOPCache tracks the latest PAT, PMTs and the position of the latest key
+// frame of a transport stream in the ring buffer, so that new clients can
+// begin playing from the key frame immediately instead of waiting for the
+// next one.
+type tsGOPCache struct {
+	maxSize int64
+	pat     []byte
+	pmts    map[uint16][]byte
+
+	// keyframe is the position of the latest key frame, it is -1 if no key
+	// frame has been received
+	keyframe int64
+}
+
+func newTSGOPCache(maxSize int) *tsGOPCache {
+	return &tsGOPCache{
+		maxSize:  int64(maxSize),
+		pmts:     map[uint16][]byte{},
+		keyframe: -1,
+	}
+}
+
+// update updates the cache with the data which is being written to the ring
+// buffer at position 'pos'. Only the first packet of PAT and PMTs are cached,
+// this is fine because they are almost always fit in one packet.
+func (c *tsGOPCache) update(buf []byte, pos int64, psi *tsPSIParser) {
+	for off := 0; off+tsPacketSize <= len(buf); {
+		pkt := buf[off : off+tsPacketSize]
+		if pkt[0] != tsSyncByte {
+			off++
+			continue
+		}
+
+		pid := tsPID(pkt)
+		if pid == tsPIDPAT && tsPayloadUnitStart(pkt) {
+			c.pat = append(c.pat[:0], pkt...)
+			// remove PMTs which are no longer referenced by the PAT
+			for pmtPID := range c.pmts {
+				if !psi.isPMTPID(pmtPID) {
+					delete(c.pmts, pmtPID)
+				}
+			}
+		} else if psi.isPMTPID(pid) && tsPayloadUnitStart(pkt) {
+			c.pmts[pid] = append(c.pmts[pid][:0], pkt...)
+		}
+
+		if tsRandomAccess(pkt) && psi.isVideoPID(pid) {
+			c.keyframe = pos + int64(off)
+		}
+
+		off += tsPacketSize
+	}
+}
+
+// snapshot returns the prelude and the start position of a new client, the
+// prelude is a copy of PAT and PMTs, and the start position is the latest
+// key frame. If there's no key frame, or the GOP since the key frame is
+// larger than 'maxSize', the prelude is nil and the start position is 'end'.
+func (c *tsGOPCache) snapshot(end int64) ([]byte, int64) {
+	if c.keyframe < 0 || c.pat == nil || end-c.keyframe > c.maxSize {
+		return nil, end
+	}
+
+	buf := make([]byte, 0, tsPacketSize*(1+len(c.pmts)))
+	buf = append(buf, c.pat...)
+	for _, pmt := range c.pmts {
+		buf = append(buf, pmt...)
+	}
+	return buf, c.keyframe
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sourceHealth is the health status of a multicast source, the unit of
+// 'Bitrate' is bit per second.
+type sourceHealth struct {
+	Source    string    `json:"source"`
+	Channels  []string  `json:"channels"`
+	Alive     bool      `json:"alive"`
+	Bitrate   int64     `json:"bitrate"`
+	LastSeen  time.Time `json:"lastSeen"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+var (
+	sourceHealths    = map[string]*sourceHealth{}
+	sourceHealthLock sync.Mutex
+
+	// healthCheckNow triggers a health check immediately
+	healthCheckNow = make(chan struct{}, 1)
+)
+
+// checkSource joins the multicast group of the source for the duration, and
+// measures the bitrate of the received data. The connection is shared with
+// other clients if the source is being relayed. The error is returned if the
+// source could not be joined.
+func checkSource(src string, duration time.Duration) (bool, int64, error) {
+	mc, created, err := mcastJoin(src)
+	if err != nil {
+		return false, 0, err
+	}
+
+	rc := mc.attachClient("health-check", created)
+	rc.live()
+	start := time.Now()
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	// the data before the check is skipped by 'live', as it was not received
+	// during the check
+	size := int64(0)
+
+LOOP:
+	for {
+		select {
+		case <-rc.ready():
+			size += int64(len(rc.read()))
+		case <-rc.ctx.Done():
+			break LOOP
+		case <-timer.C:
+			break LOOP
+		}
+	}
+
+	mc.detachClient(rc)
+
+	if size == 0 {
+		return false, 0, nil
+	}
+	return true, size * 8 * int64(time.Second) / int64(time.Since(start)), nil
+}
+
+// checkAllSources checks the health of all multicast sources one by one, to
+// avoid consuming too much bandwidth.
+func checkAllSources() {
+	channels := map[string][]string{}
+	channelGroupForEach(func(group *ChannelGroup) {
+		for _, ch := range group.Channels {
+			for _, src := range ch.Sources {
+				if !isUnicastSource(src) {
+					channels[src] = append(channels[src], ch.Name)
+				}
+			}
+		}
+	})
+
+	sources := make([]string, 0, len(channels))
+	for src := range channels {
+		sources = append(sources, src)
+	}
+	slices.Sort(sources)
+
+	slog.Info("source health check started", slog.Int("sources", len(sources)))
+
+	dead, skipped := 0, 0
+	duration := time.Duration(getConfig().HealthCheckDuration) * time.Second
+	for _, src := range sources {
+		alive, bitrate, err := checkSource(src, duration)
+		now := time.Now()
+
+		// the source could not be checked because of the relay limits, it
+		// is skipped and its last result is kept
+		if errors.Is(err, errLimitExceeded) {
+			skipped++
+			slog.Info(
+				"source health check skipped",
+				slog.String("source", src),
+				slog.String("reason", err.Error()),
+			)
+			continue
+		}
+
+		sourceHealthLock.Lock()
+		sh := sourceHealths[src]
+		if sh == nil {
+			sh = &sourceHealth{Source: src}
+			sourceHealths[src] = sh
+		}
+		sh.Channels = channels[src]
+		sh.Alive = alive
+		sh.Bitrate = bitrate
+		sh.CheckedAt = now
+		if alive {
+			sh.LastSeen = now
+		}
+		sourceHealthLock.Unlock()
+
+		if !alive {
+			dead++
+			slog.Warn(
+				"source is dead",
+				slog.String("source", src),
+				slog.Any("channels", channels[src]),
+			)
+		}
+	}
+
+	// remove sources which are no longer in the channel list
+	sourceHealthLock.Lock()
+	for src := range sourceHealths {
+		if _, ok := channels[src]; !ok {
+			delete(sourceHealths, src)
+		}
+	}
+	sourceHealthLock.Unlock()
+
+	slog.Info(
+		"source health check finished",
+		slog.Int("sources", len(sources)),
+		slog.Int("dead", dead),
+		slog.Int("skipped", skipped),
+	)
+}
+
+// initHealthCheck starts the background source health checker, the first
+// check begins one minute after the program starts.
+func initHealthCheck() {
+	go func() {
+		wait := time.Minute
+		for {
+			select {
+			case <-time.After(wait):
+				if getConfig().HealthCheckInterval > 0 {
+					checkAllSources()
+				}
+			case <-healthCheckNow:
+				checkAllSources()
+			}
+
+			// if the health check is disabled, we still need to check the
+			// configuration periodically, as it may be enabled later.
+			wait = time.Minute
+			if interval := getConfig().HealthCheckInterval; interval > 0 {
+				wait = time.Duration(interval) * time.Minute
+			}
+		}
+	}()
+}
+
+// apiListSourceHealth lists the health status of all multicast sources
+func apiListSourceHealth(w http.ResponseWriter, r *http.Request) {
+	_ = r
+
+	sourceHealthLock.Lock()
+	result := make([]sourceHealth, 0, len(sourceHealths))
+	for _, sh := range sourceHealths {
+		result = append(result, *sh)
+	}
+	sourceHealthLock.Unlock()
+
+	slices.SortFunc(result, func(a, b sourceHealth) int {
+		if a.Alive != b.Alive {
+			// dead sources first
+			if a.Alive {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(a.Source, b.Source)
+	})
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(result)
+}
+
+// apiCheckSourceHealth triggers a health check of all multicast sources, the
+// check runs in background, its result could be retrieved by
+// 'apiListSourceHealth' later.
+func apiCheckSourceHealth(w http.ResponseWriter, r *http.Request) {
+	select {
+	case healthCheckNow <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
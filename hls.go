@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hlsIdleTimeout is the duration after which an HLS session is closed if no
+// client requests its playlist or segments
+const hlsIdleTimeout = 30 * time.Second
+
+// hlsSegment is a segment of an HLS live stream
+type hlsSegment struct {
+	seq      int
+	duration time.Duration
+	data     []byte
+}
+
+// hlsSession cuts the MPEG-TS stream of a multicast connection into rolling
+// segments, it is a client of the multicast connection just like the HTTP
+// relay clients.
+type hlsSession struct {
+	mc         *mcastConn
+	rc         *relayClient
+	lastAccess atomic.Int64
+
+	// ready is closed when the first segment is available
+	ready    chan struct{}
+	lock     sync.Mutex
+	segments []*hlsSegment
+
+	// below fields are only accessed by the 'run' goroutine
+	target   time.Duration
+	started  bool
+	pat      []byte
+	pmtPIDs  map[uint16]bool
+	pmts     map[uint16][]byte
+	cur      []byte
+	curStart time.Time
+	nextSeq  int
+}
+
+var (
+	hlsSessions = map[string]*hlsSession{}
+	hlsLock     sync.Mutex
+)
+
+// clientAddr returns the address used to identify the session in the client
+// list of the multicast connection
+func (hs *hlsSession) clientAddr() string {
+	return "hls"
+}
+
+func (hs *hlsSession) touch() {
+	hs.lastAccess.Store(time.Now().UnixNano())
+}
+
+// getSegments returns the segments which should be listed in the playlist
+func (hs *hlsSession) getSegments() []*hlsSegment {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	segs := hs.segments
+	if n := getConfig().HLSPlaylistSize; len(segs) > n {
+		segs = segs[len(segs)-n:]
+	}
+	result := make([]*hlsSegment, len(segs))
+	copy(result, segs)
+	return result
+}
+
+// getSegment returns the segment with the sequence number, or nil if it does
+// not exist
+func (hs *hlsSession) getSegment(seq int) *hlsSegment {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	for _, seg := range hs.segments {
+		if seg.seq == seq {
+			return seg
+		}
+	}
+	return nil
+}
+
+// finishSegment adds the current segment to the segment list, and begins a
+// new segment with the latest PAT and PMTs, so that every segment can be
+// decoded independently.
+func (hs *hlsSession) finishSegment(now time.Time) {
+	seg := &hlsSegment{
+		seq:      hs.nextSeq,
+		duration: now.Sub(hs.curStart),
+		data:     hs.cur,
+	}
+	hs.nextSeq++
+
+	hs.lock.Lock()
+	hs.segments = append(hs.segments, seg)
+	// keep 2 more segments than the playlist size for clients which are
+	// still downloading the segments of the previous playlist
+	if n := getConfig().HLSPlaylistSize + 2; len(hs.segments) > n {
+		hs.segments = hs.segments[len(hs.segments)-n:]
+	}
+	if seg.seq == 0 {
+		close(hs.ready)
+	}
+	hs.lock.Unlock()
+
+	hs.cur = make([]byte, 0, len(seg.data)+tsPacketSize*8)
+	hs.curStart = now
+	hs.writePSI()
+}
+
+// writePSI appends the latest PAT and PMTs to the current segment
+func (hs *hlsSession) writePSI() {
+	if hs.pat == nil {
+		return
+	}
+	hs.cur = append(hs.cur, hs.pat...)
+	for _, pmt := range hs.pmts {
+		hs.cur = append(hs.cur, pmt...)
+	}
+}
+
+// handlePacket handles a MPEG-TS packet
+func (hs *hlsSession) handlePacket(pkt []byte, now time.Time) {
+	pid := tsPID(pkt)
+
+	if pid == tsPIDPAT {
+		if programs := tsParsePAT(tsPSISection(pkt)); programs != nil {
+			hs.pat = append(hs.pat[:0], pkt...)
+			hs.pmtPIDs = make(map[uint16]bool, len(programs))
+			for _, pmtPID := range programs {
+				hs.pmtPIDs[pmtPID] = true
+			}
+			for pmtPID := range hs.pmts {
+				if !hs.pmtPIDs[pmtPID] {
+					delete(hs.pmts, pmtPID)
+				}
+			}
+		}
+	} else if hs.pmtPIDs[pid] && tsPayloadUnitStart(pkt) {
+		hs.pmts[pid] = append(hs.pmts[pid][:0], pkt...)
+	}
+
+	keyFrame := tsRandomAccess(pkt)
+
+	// the first segment should begin with a key frame, but some streams
+	// never set the random access indicator, so we don't wait forever
+	if !hs.started {
+		if !keyFrame && now.Sub(hs.curStart) < hs.target {
+			return
+		}
+		hs.started = true
+		hs.curStart = now
+		hs.writePSI()
+	}
+
+	elapsed := now.Sub(hs.curStart)
+	if (keyFrame && elapsed >= hs.target) || elapsed >= 3*hs.target {
+		hs.finishSegment(now)
+	}
+
+	hs.cur = append(hs.cur, pkt...)
+}
+
+// run receives data from the multicast connection and cuts it into segments
+// until the session is closed or idle for too long
+func (hs *hlsSession) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// begin with the data from the GOP cache
+	now := time.Now()
+	tsForEachPacket(hs.rc.prelude, func(pkt []byte) {
+		hs.handlePacket(pkt, now)
+	})
+	hs.rc.prelude = nil
+
+LOOP:
+	for {
+		select {
+		case <-hs.rc.ready():
+			now := time.Now()
+			tsForEachPacket(hs.rc.read(), func(pkt []byte) {
+				hs.handlePacket(pkt, now)
+			})
+		case <-ticker.C:
+			last := time.Unix(0, hs.lastAccess.Load())
+			if time.Since(last) > hlsIdleTimeout {
+				break LOOP
+			}
+		case <-hs.rc.ctx.Done():
+			break LOOP
+		}
+	}
+
+	hlsLock.Lock()
+	if hlsSessions[hs.mc.addr] == hs {
+		delete(hlsSessions, hs.mc.addr)
+	}
+	hlsLock.Unlock()
+
+	hs.mc.detachClient(hs.rc)
+
+	slog.Info("HLS session closed", slog.String("multicastAddress", hs.mc.addr))
+}
+
+// getHLSSession returns the HLS session of the requested multicast address,
+// a new session is created if it does not exist
+func getHLSSession(w http.ResponseWriter, r *http.Request) *hlsSession {
+	addr := r.PathValue("addr")
+	hlsLock.Lock()
+	hs := hlsSessions[addr]
+	hlsLock.Unlock()
+	if hs != nil {
+		return hs
+	}
+
+	// connecting may block for a while, so it is done without the lock, and
+	// the new session is discarded if another one is created meanwhile
+	mc, created := mcastConnect(w, r)
+	if mc == nil {
+		return nil
+	}
+
+	now := time.Now()
+	hs = &hlsSession{
+		mc:       mc,
+		ready:    make(chan struct{}),
+		target:   time.Duration(getConfig().HLSSegmentDuration) * time.Second,
+		pmtPIDs:  map[uint16]bool{},
+		pmts:     map[uint16][]byte{},
+		curStart: now,
+	}
+	hs.touch()
+	hs.rc = mc.newClient(hs.clientAddr())
+	hs.rc.player = true
+	if err := mc.attach(hs.rc, created); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil
+	}
+
+	hlsLock.Lock()
+	if other := hlsSessions[addr]; other != nil {
+		hlsLock.Unlock()
+		mc.detachClient(hs.rc)
+		return other
+	}
+	hlsSessions[addr] = hs
+	hlsLock.Unlock()
+
+	go hs.run()
+	slog.Info("HLS session created", slog.String("multicastAddress", mc.addr))
+	return hs
+}
+
+// iptvHLSPlaylist serves the live HLS playlist of a multicast IPTV channel
+func iptvHLSPlaylist(w http.ResponseWriter, r *http.Request) {
+	hs := getHLSSession(w, r)
+	if hs == nil {
+		return
+	}
+	hs.touch()
+
+	// wait for the first segment
+	cfg := getConfig()
+	timeout := 3*hs.target + time.Duration(cfg.ReadTimeout)*time.Millisecond
+	select {
+	case <-hs.ready:
+	case <-hs.rc.ctx.Done():
+		http.Error(w, "multicast connection closed", http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		return
+	case <-time.After(timeout):
+		http.Error(w, "no data received", http.StatusServiceUnavailable)
+		return
+	}
+
+	segs := hs.getSegments()
+	maxDur := time.Duration(0)
+	for _, seg := range segs {
+		maxDur = max(maxDur, seg.duration)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&sb, "#EXT-X-TARGETDURATION:%d\n", int((maxDur+time.Second-1)/time.Second))
+	fmt.Fprintf(&sb, "#EXT-X-MEDIA-SEQUENCE:%d\n", segs[0].seq)
+	for _, seg := range segs {
+		fmt.Fprintf(&sb, "#EXTINF:%.3f,\n%d.ts\n", seg.duration.Seconds(), seg.seq)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(sb.String()))
+}
+
+// iptvHLSSegment serves a segment of the live HLS stream
+func iptvHLSSegment(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutSuffix(r.PathValue("segment"), ".ts")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	seq, err := strconv.Atoi(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	hlsLock.Lock()
+	hs := hlsSessions[r.PathValue("addr")]
+	hlsLock.Unlock()
+	if hs == nil {
+		http.NotFound(w, r)
+		return
+	}
+	hs.touch()
+
+	seg := hs.getSegment(seq)
+	if seg == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/MP2T")
+	w.Header().Set("Content-Length", strconv.Itoa(len(seg.data)))
+	w.Write(seg.data)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errLimitExceeded is returned by mcastJoin and attach if a limit in the
+// configuration would be exceeded
+var errLimitExceeded = errors.New("relay limit exceeded")
+
+// defaultBitrate is the bitrate assumed for a source whose bitrate is not
+// known yet, it is a conservative value of a HD channel, in bit per second
+const defaultBitrate = 10_000_000
+
+var (
+	// joinLock serializes the checking of limits and the creation of relay
+	// connections, so that concurrent joins cannot exceed the limits
+	joinLock sync.Mutex
+
+	// knownBitrates is the bitrate of the closed relay connections, which
+	// is used to estimate the bitrate of a connection before it is created
+	knownBitrates sync.Map
+)
+
+// isLimitedSource reports whether a source counts toward the group and
+// bandwidth limits, local files do not consume the bandwidth of the line.
+func isLimitedSource(addr string) bool {
+	return !isFileSource(addr)
+}
+
+// estimateBitrate returns the estimated bitrate of a source in bit per
+// second, it is the bitrate when the source was relayed last time, or the
+// average bitrate of the active connections if the source is unknown, or
+// 'fallback' if there is no active connection.
+func estimateBitrate(addr string, total int64, count int, fallback int64) int64 {
+	if v, ok := knownBitrates.Load(addr); ok {
+		return v.(int64)
+	}
+	if count == 0 {
+		return fallback
+	}
+	return total / int64(count)
+}
+
+// checkJoinLimits checks whether a new connection to the source could be
+// created without exceeding the group and bandwidth limits, lingering
+// connections are closed to make room for it if necessary. The caller must
+// hold 'joinLock'.
+func checkJoinLimits(addr string) error {
+	cfg := getConfig()
+	if !isLimitedSource(addr) || (cfg.MaxGroups <= 0 && cfg.MaxBandwidth <= 0) {
+		return nil
+	}
+
+	// the default bitrate is capped by the limit, so that a source is not
+	// rejected only because its bitrate is unknown and no other is joined
+	limit := int64(cfg.MaxBandwidth) * 1000
+	fallback := int64(defaultBitrate)
+	if limit > 0 {
+		fallback = min(fallback, limit)
+	}
+
+	for {
+		var (
+			count   int
+			bitrate int64
+			oldest  *mcastConn
+			since   time.Time
+		)
+
+		mcastConns.Range(func(k, v any) bool {
+			mc := v.(*mcastConn)
+			if !isLimitedSource(mc.addr) || mc.ctx.Err() != nil {
+				return true
+			}
+			count++
+
+			// the meter is not ready in the first second of a connection,
+			// it is counted at the estimated bitrate instead of zero, so
+			// that fast zapping could not bypass the bandwidth limit
+			if b := mc.rate.bitrate(); b > 0 {
+				bitrate += b
+			} else {
+				bitrate += estimateBitrate(mc.addr, 0, 0, fallback)
+			}
+
+			mc.clientLock.Lock()
+			idleSince := mc.idleSince
+			mc.clientLock.Unlock()
+			if !idleSince.IsZero() && (oldest == nil || idleSince.Before(since)) {
+				oldest, since = mc, idleSince
+			}
+			return true
+		})
+
+		var err error
+		if cfg.MaxGroups > 0 && count >= cfg.MaxGroups {
+			err = fmt.Errorf("%w: max groups (%d) reached", errLimitExceeded, cfg.MaxGroups)
+		} else if limit > 0 {
+			if estimated := bitrate + estimateBitrate(addr, bitrate, count, fallback); estimated > limit {
+				err = fmt.Errorf(
+					"%w: max bandwidth (%d kbps) would be exceeded, current %d kbps, estimated %d kbps",
+					errLimitExceeded,
+					cfg.MaxBandwidth,
+					bitrate/1000,
+					estimated/1000,
+				)
+			}
+		}
+
+		if err == nil {
+			return nil
+		}
+		if oldest == nil {
+			slog.Warn(
+				"relay connection rejected",
+				slog.String("address", addr),
+				slog.String("reason", err.Error()),
+			)
+			return err
+		}
+
+		slog.Info(
+			"lingering relay connection closed for a new connection",
+			slog.String("address", oldest.addr),
+			slog.String("newAddress", addr),
+		)
+		oldest.cancel()
+	}
+}
+
+// checkClientLimit checks whether a new client could be added to the
+// connection without exceeding the client limit of a group, the caller must
+// hold 'mc.clientLock', so that the count does not change before the client
+// is added.
+func checkClientLimit(mc *mcastConn) error {
+	limit := getConfig().MaxGroupClients
+	if limit <= 0 {
+		return nil
+	}
+
+	count := 0
+	for _, rc := range mc.clients {
+		if rc != nil {
+			count++
+		}
+	}
+	if count < limit {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: max clients (%d) of the group reached", errLimitExceeded, limit)
+	slog.Warn(
+		"relay client rejected",
+		slog.String("address", mc.addr),
+		slog.String("reason", err.Error()),
+	)
+	return err
+}
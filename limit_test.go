@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestClientLimit(t *testing.T) {
+	cfg := &Config{
+		ServerAddr:      "127.0.0.1:7709",
+		McastIface:      "lo",
+		MaxGroupClients: 4,
+	}
+	cfg.populateDefault()
+	old := config.Load()
+	config.Store(cfg)
+	t.Cleanup(func() {
+		if old != nil {
+			config.Store(old)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mc := &mcastConn{
+		addr:   "239.0.0.1:5000",
+		ring:   newRelayRing(cfg.RelayBufferSize, cfg.WriteBufferSize, newTSGOPCache(cfg.GOPCacheSize)),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	// an internal client is counted but never rejected
+	mc.attachClient("health-check", false)
+
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		rejected int
+	)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc := mc.newClient("player")
+			rc.player = true
+			err := mc.attach(rc, false)
+			if err == nil {
+				return
+			}
+			if !errors.Is(err, errLimitExceeded) {
+				t.Error(err)
+			}
+			lock.Lock()
+			rejected++
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if rejected != 7 {
+		t.Fatalf("unexpected number of rejected clients: %d", rejected)
+	}
+	if n := len(mc.getClients()); n != 4 {
+		t.Fatalf("unexpected number of clients: %d", n)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"embed"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/fs"
 	"log"
 	"log/slog"
@@ -67,7 +68,23 @@ func main() {
 	slog.Info("MyIPTV", slog.String("version", Version))
 
 	loadConfig()
+
+	// sub commands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "scan":
+			os.Exit(cliScan(os.Args[2:]))
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command: %s\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+
 	initDDNS()
+	initHealthCheck()
+	initRecordings()
+	initTimeshift()
+	initOutputs()
 
 	// the website
 	dist, _ := fs.Sub(website, "webui/dist")
@@ -101,18 +118,50 @@ func main() {
 	http.HandleFunc("GET /api/channel-groups", apiListChannelGroups)
 	http.HandleFunc("PUT /api/channel-groups", apiUpdateChannelGroups)
 
+	http.HandleFunc("GET /api/source-health", apiListSourceHealth)
+	http.HandleFunc("POST /api/source-health", apiCheckSourceHealth)
+
+	http.HandleFunc("GET /api/scan", apiGetScan)
+	http.HandleFunc("POST /api/scan", apiStartScan)
+	http.HandleFunc("DELETE /api/scan", apiCancelScan)
+
+	http.HandleFunc("GET /api/recordings", apiListRecordings)
+	http.HandleFunc("POST /api/recordings", apiCreateRecording)
+	http.HandleFunc("GET /api/recordings/{id}", apiDownloadRecording)
+	http.HandleFunc("DELETE /api/recordings/{id}", apiDeleteRecording)
+
+	http.HandleFunc("GET /api/timeshift", apiListTimeshiftBuffers)
+
+	http.HandleFunc("GET /api/outputs", apiListOutputs)
+	http.HandleFunc("POST /api/outputs", apiCreateOutput)
+	http.HandleFunc("PUT /api/outputs/{id}", apiUpdateOutput)
+	http.HandleFunc("DELETE /api/outputs/{id}", apiDeleteOutput)
+
 	http.HandleFunc("GET /api/epg/{channel}", apiGetEPG)
 	http.HandleFunc("POST /api/epg", apiUpdateEPG)
 
 	http.HandleFunc("GET /api/relays", apiListRelays)
+	http.HandleFunc("GET /api/relay-linger", apiGetLingerStats)
+	http.HandleFunc("GET /api/relays/{addr}/info", apiGetRelayInfo)
+	http.HandleFunc("GET /api/ts-errors", apiListTSErrorHistory)
 	http.HandleFunc("DELETE /api/relays/{addr}", apiCloseRelayConnection)
 	http.HandleFunc("DELETE /api/relays/{addr}/{client}", apiCloseRelayClient)
 
 	// for IPTV clients
 	http.HandleFunc("GET /iptv/relay/{addr}", iptvRelay)
+	http.HandleFunc("GET /iptv/channel/{name}", iptvChannelRelay)
+	http.HandleFunc("GET /iptv/hls/{addr}/index.m3u8", iptvHLSPlaylist)
+	http.HandleFunc("GET /iptv/hls/{addr}/{segment}", iptvHLSSegment)
 	http.HandleFunc("GET /iptv/channels", iptvListChannels)
 	http.HandleFunc("GET /iptv/epg", iptvGetEPG)
 
+	// udpxy compatible URLs, so that MyIPTV could replace udpxy without
+	// modifying the playlists, both are handled by 'iptvRelay' as it detects
+	// RTP automatically
+	http.HandleFunc("GET /udp/{addr}", iptvRelay)
+	http.HandleFunc("GET /rtp/{addr}", iptvRelay)
+	http.HandleFunc("GET /status", udpxyStatus)
+
 	// run and wait `Ctrl-C` or `Term` to exit
 	run()
 	signals := make(chan os.Signal, 1)
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outputPacketSize is the size of the MPEG-TS data in an output datagram,
+// 7 TS packets is the common practice of IPTV
+const outputPacketSize = 7 * tsPacketSize
+
+// outputPaceSlack is how far the sender could run ahead of the schedule
+// before it waits, waiting for every datagram is too costly
+const outputPaceSlack = 2 * time.Millisecond
+
+// Output is a re-streaming output, which sends the MPEG-TS stream of a source
+// to a UDP unicast or multicast address
+type Output struct {
+	ID string `json:"id"`
+
+	// Source is the source of the stream, it could be any source supported
+	// by the relay, such as a multicast address
+	Source string `json:"source"`
+
+	// Dest is the destination address, such as '192.168.2.10:1234',
+	// '239.1.1.1:5000' or '[ff3e::1]:5000'
+	Dest string `json:"dest"`
+
+	// Iface is the name of the outgoing network interface if the destination
+	// is a multicast address, the system default is used if it is empty
+	Iface string `json:"iface,omitempty"`
+
+	// TTL is the TTL (hop limit for IPv6) of the multicast packets, the
+	// system default (generally 1) is used if it is zero
+	TTL int `json:"ttl,omitempty"`
+
+	// RTP specifies whether the stream is encapsulated in RTP packets
+	RTP bool `json:"rtp,omitempty"`
+}
+
+// outputRunner runs an output, it is a persistent client of the connection of
+// the source
+type outputRunner struct {
+	out    Output
+	cancel context.CancelFunc
+	done   chan struct{}
+	sent   atomic.Int64
+
+	lock   sync.Mutex
+	status string
+	err    string
+
+	// below fields are only accessed by the 'run' goroutine, 'next' is the
+	// time to send the next datagram, see 'pace'
+	conn  *net.UDPConn
+	dest  *net.UDPAddr
+	buf   []byte
+	seq   uint16
+	ssrc  uint32
+	start time.Time
+	next  time.Time
+	timer *time.Timer
+}
+
+const (
+	outputWaiting = "waiting"
+	outputRunning = "running"
+	outputFailed  = "failed"
+)
+
+var (
+	// outputs is the output list in the configuration file, it is protected
+	// by 'configLock'
+	outputs []Output
+
+	outputRunners = map[string]*outputRunner{}
+	outputLock    sync.Mutex
+)
+
+// validateOutput checks the output, and resolves its destination address
+func validateOutput(out *Output) (*net.UDPAddr, error) {
+	if err := validateSource(out.Source); err != nil {
+		return nil, err
+	}
+	dest, err := net.ResolveUDPAddr("udp", out.Dest)
+	if err != nil {
+		return nil, err
+	}
+	if dest.Port == 0 || dest.IP == nil || dest.IP.IsUnspecified() {
+		return nil, errors.New("invalid destination address")
+	}
+	return dest, nil
+}
+
+func (or *outputRunner) setStatus(status string, err error) {
+	or.lock.Lock()
+	defer or.lock.Unlock()
+	or.status = status
+	or.err = ""
+	if err != nil {
+		or.err = err.Error()
+	}
+}
+
+// open creates the UDP connection of the output
+func (or *outputRunner) open(dest *net.UDPAddr) error {
+	network := "udp4"
+	if dest.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return err
+	}
+
+	if dest.IP.IsMulticast() {
+		if or.out.Iface != "" {
+			iface, err := net.InterfaceByName(or.out.Iface)
+			if err == nil {
+				err = setMulticastInterface(conn, iface)
+			}
+			if err != nil {
+				conn.Close()
+				return err
+			}
+		}
+		if or.out.TTL > 0 {
+			if err = setMulticastTTL(conn, or.out.TTL); err != nil {
+				conn.Close()
+				return err
+			}
+		}
+	}
+
+	or.conn = conn
+	or.dest = dest
+	return nil
+}
+
+// pace waits until the next datagram is due after a datagram of 'n' bytes is
+// sent, so that the datagrams of a chunk are spread at the bitrate of the
+// source instead of being sent in a burst, which may overflow the buffer of
+// the receiver. No wait if 'bitrate' is unknown (zero). It returns false if
+// the context is done while waiting.
+func (or *outputRunner) pace(ctx context.Context, n int, bitrate int64) bool {
+	if bitrate <= 0 {
+		return true
+	}
+
+	// do not catch up with a burst if the sender fell behind the schedule,
+	// and the bitrate is raised by 1/16 so that the queued data is drained
+	now := time.Now()
+	if or.next.Before(now) {
+		or.next = now
+	}
+	bitrate += bitrate / 16
+	or.next = or.next.Add(time.Duration(int64(n) * 8 * int64(time.Second) / bitrate))
+
+	d := or.next.Sub(now)
+	if d < outputPaceSlack {
+		return true
+	}
+	if or.timer == nil {
+		or.timer = time.NewTimer(d)
+	} else {
+		or.timer.Reset(d)
+	}
+	select {
+	case <-or.timer.C:
+		return true
+	case <-ctx.Done():
+		if !or.timer.Stop() {
+			<-or.timer.C
+		}
+		return false
+	}
+}
+
+// send sends the data to the destination, it is split into datagrams of
+// 'outputPacketSize' bytes and paced by 'bitrate', see 'pace'. Errors are
+// ignored, as the receiver may be offline temporarily.
+func (or *outputRunner) send(ctx context.Context, data []byte, bitrate int64) {
+	for len(data) > 0 {
+		n := min(len(data), outputPacketSize)
+
+		pkt := data[:n]
+		if or.out.RTP {
+			ts := uint32(time.Since(or.start) * 90000 / time.Second)
+			or.buf = append(or.buf[:0], 0x80, 33, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint16(or.buf[2:], or.seq)
+			binary.BigEndian.PutUint32(or.buf[4:], ts)
+			binary.BigEndian.PutUint32(or.buf[8:], or.ssrc)
+			or.buf = append(or.buf, pkt...)
+			or.seq++
+			pkt = or.buf
+		}
+
+		if _, err := or.conn.WriteToUDP(pkt, or.dest); err != nil {
+			slog.Debug(
+				"failed to send output data",
+				slog.String("output", or.out.ID),
+				slog.String("error", err.Error()),
+			)
+		} else {
+			or.sent.Add(int64(n))
+		}
+
+		data = data[n:]
+		if !or.pace(ctx, n, bitrate) {
+			return
+		}
+	}
+}
+
+// relay sends the data from the source to the destination until the context
+// is done or the connection of the source is closed
+func (or *outputRunner) relay(ctx context.Context) error {
+	mc, created, err := mcastJoin(or.out.Source)
+	if err != nil {
+		return err
+	}
+
+	rc := mc.attachClient("output-"+or.out.ID, created)
+	defer mc.detachClient(rc)
+
+	// the GOP cache is not sent, as a burst of UDP packets may overflow the
+	// buffer of the receiver
+	rc.live()
+	or.setStatus(outputRunning, nil)
+
+	for {
+		select {
+		case <-rc.ready():
+			// no pacing if the output lags, so that it catches up quickly
+			data, bitrate := rc.read(), mc.rate.bitrate()
+			if rc.lag() > int64(len(rc.buf)) {
+				bitrate = 0
+			}
+			or.send(ctx, data, bitrate)
+		case <-rc.ctx.Done():
+			if mc.ctx.Err() != nil {
+				return errors.New("source connection closed")
+			}
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// run runs the output until the context is done, it re-connects to the
+// source if the connection is closed, and retries opening the output if it
+// fails, e.g. the network interface is not up yet.
+func (or *outputRunner) run(ctx context.Context) {
+	defer close(or.done)
+
+	dest, err := validateOutput(&or.out)
+	if err != nil {
+		slog.Error(
+			"invalid output",
+			slog.String("output", or.out.ID),
+			slog.String("error", err.Error()),
+		)
+		or.setStatus(outputFailed, err)
+		return
+	}
+	defer func() {
+		if or.conn != nil {
+			or.conn.Close()
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if or.conn == nil {
+			err = or.open(dest)
+			if err != nil {
+				slog.Error(
+					"failed to open output",
+					slog.String("output", or.out.ID),
+					slog.String("error", err.Error()),
+				)
+			}
+		}
+		if or.conn != nil {
+			err = or.relay(ctx)
+			if err != nil {
+				slog.Warn(
+					"output source failed",
+					slog.String("output", or.out.ID),
+					slog.String("source", or.out.Source),
+					slog.String("error", err.Error()),
+				)
+			}
+		}
+		or.setStatus(outputWaiting, err)
+
+		select {
+		case <-time.After(time.Duration(getConfig().ReadTimeout) * time.Millisecond):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// startOutput starts the runner of an output, the caller must hold
+// 'outputLock'.
+func startOutput(out Output) {
+	ctx, cancel := context.WithCancel(context.Background())
+	or := &outputRunner{
+		out:    out,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		status: outputWaiting,
+		ssrc:   rand.Uint32(),
+		start:  time.Now(),
+	}
+	outputRunners[out.ID] = or
+	go or.run(ctx)
+
+	slog.Info(
+		"output started",
+		slog.String("output", out.ID),
+		slog.String("source", out.Source),
+		slog.String("destination", out.Dest),
+	)
+}
+
+// stopOutput stops the runner of an output and waits for it to exit, the
+// caller must hold 'outputLock'.
+func stopOutput(id string) {
+	or := outputRunners[id]
+	if or == nil {
+		return
+	}
+	or.cancel()
+	<-or.done
+	delete(outputRunners, id)
+	slog.Info("output stopped", slog.String("output", id))
+}
+
+// initOutputs starts the outputs in the configuration file
+func initOutputs() {
+	configLock.Lock()
+	list := slices.Clone(outputs)
+	configLock.Unlock()
+
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	for _, out := range list {
+		startOutput(out)
+	}
+}
+
+// saveOutputs replaces the output list and saves the configuration file, the
+// caller must hold 'configLock'
+func saveOutputs(list []Output) error {
+	old := outputs
+	outputs = list
+	if err := saveConfig(getConfig(), channelGroups); err != nil {
+		outputs = old
+		return err
+	}
+	return nil
+}
+
+// decodeOutput decodes and validates the output in the request body
+func decodeOutput(w http.ResponseWriter, r *http.Request) (Output, bool) {
+	var out Output
+	if err := json.NewDecoder(r.Body).Decode(&out); err != nil {
+		slog.Error(
+			"failed to decode request body",
+			slog.String("error", err.Error()),
+		)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return out, false
+	}
+	if _, err := validateOutput(&out); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return out, false
+	}
+	return out, true
+}
+
+// apiListOutputs lists all outputs and their status, the unit of 'sent' is
+// byte
+func apiListOutputs(w http.ResponseWriter, r *http.Request) {
+	_ = r
+
+	type Status struct {
+		Output
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+		Sent   int64  `json:"sent"`
+	}
+
+	configLock.Lock()
+	list := slices.Clone(outputs)
+	configLock.Unlock()
+
+	result := make([]Status, 0, len(list))
+	outputLock.Lock()
+	for _, out := range list {
+		st := Status{Output: out, Status: outputFailed}
+		if or := outputRunners[out.ID]; or != nil {
+			or.lock.Lock()
+			st.Status, st.Error = or.status, or.err
+			or.lock.Unlock()
+			st.Sent = or.sent.Load()
+		}
+		result = append(result, st)
+	}
+	outputLock.Unlock()
+
+	slices.SortFunc(result, func(a, b Status) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(result)
+}
+
+// apiCreateOutput creates and starts an output
+func apiCreateOutput(w http.ResponseWriter, r *http.Request) {
+	out, ok := decodeOutput(w, r)
+	if !ok {
+		return
+	}
+	out.ID = fmt.Sprintf("%08x", rand.Uint32())
+
+	configLock.Lock()
+	err := saveOutputs(append(slices.Clone(outputs), out))
+	configLock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	outputLock.Lock()
+	startOutput(out)
+	outputLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&out)
+}
+
+// apiUpdateOutput updates an output, the output is restarted
+func apiUpdateOutput(w http.ResponseWriter, r *http.Request) {
+	out, ok := decodeOutput(w, r)
+	if !ok {
+		return
+	}
+	out.ID = r.PathValue("id")
+
+	configLock.Lock()
+	list := slices.Clone(outputs)
+	i := slices.IndexFunc(list, func(o Output) bool { return o.ID == out.ID })
+	if i < 0 {
+		configLock.Unlock()
+		http.Error(w, "output not found", http.StatusNotFound)
+		return
+	}
+	list[i] = out
+	err := saveOutputs(list)
+	configLock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	outputLock.Lock()
+	stopOutput(out.ID)
+	startOutput(out)
+	outputLock.Unlock()
+}
+
+// apiDeleteOutput stops and deletes an output
+func apiDeleteOutput(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	configLock.Lock()
+	list := slices.DeleteFunc(slices.Clone(outputs), func(o Output) bool { return o.ID == id })
+	if len(list) == len(outputs) {
+		configLock.Unlock()
+		http.Error(w, "output not found", http.StatusNotFound)
+		return
+	}
+	err := saveOutputs(list)
+	configLock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	outputLock.Lock()
+	stopOutput(id)
+	outputLock.Unlock()
+}
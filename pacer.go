@@ -0,0 +1,62 @@
+package main
+
+import "time"
+
+// pcrMaxJump is the max difference between two adjacent PCRs in the 27MHz
+// clock, the pace is restarted from the latter PCR if the difference is
+// larger, or the PCR goes backwards.
+const pcrMaxJump = 27000000
+
+// pcrMaxLag is the max time a paced stream could fall behind the schedule,
+// e.g. the reader pauses, the pace is restarted if it is exceeded, so that
+// the stream is not sent in a burst to catch up.
+const pcrMaxLag = time.Second
+
+// pcrPacer paces a MPEG-TS stream by the PCR of the first PID carrying PCR,
+// so that the stream is sent like a live stream.
+type pcrPacer struct {
+	// 'base' is the PCR sent at 'start'
+	pid        uint16
+	base, last uint64
+	start      time.Time
+	restart    bool
+}
+
+func newPCRPacer() *pcrPacer {
+	return &pcrPacer{pid: tsPIDNull, restart: true}
+}
+
+// reset restarts the pace from the next PCR, it should be called if the PCR
+// is not continuous, e.g. a file is played again from its beginning.
+func (p *pcrPacer) reset() {
+	p.restart = true
+}
+
+// hasPCR reports whether a PCR has been found in the stream
+func (p *pcrPacer) hasPCR() bool {
+	return p.pid != tsPIDNull
+}
+
+// delay returns how long to wait before sending the packet, and whether the
+// packet carries the PCR used for pacing, the delay is always zero if not.
+func (p *pcrPacer) delay(pkt []byte) (time.Duration, bool) {
+	pid := tsPID(pkt)
+	pcr, ok := tsPCR(pkt)
+	if !ok || (p.pid != tsPIDNull && pid != p.pid) {
+		return 0, false
+	}
+	p.pid = pid
+
+	if p.restart || (pcr+tsPCRWrap-p.last)%tsPCRWrap > pcrMaxJump {
+		p.base, p.start, p.restart = pcr, time.Now(), false
+	}
+	p.last = pcr
+
+	elapsed := time.Duration((pcr + tsPCRWrap - p.base) % tsPCRWrap * 1000 / 27)
+	wait := time.Until(p.start.Add(elapsed))
+	if wait < -pcrMaxLag {
+		p.base, p.start = pcr, time.Now()
+		wait = 0
+	}
+	return max(wait, 0), true
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// status of recordings
+const (
+	recordingScheduled = "scheduled"
+	recordingRunning   = "recording"
+	recordingCompleted = "completed"
+	recordingFailed    = "failed"
+	recordingCanceled  = "canceled"
+)
+
+// recordingIndexFile is the file to save the recording list, it is in the
+// recording directory
+const recordingIndexFile = "recordings.json"
+
+// recording is a recording of an IPTV channel or a multicast address
+type recording struct {
+	ID       string    `json:"id"`
+	Channel  string    `json:"channel,omitempty"`
+	Addr     string    `json:"addr,omitempty"`
+	Start    time.Time `json:"start"`
+	Duration int       `json:"duration"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Size     int64     `json:"size"`
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// end returns the end time of the recording
+func (rec *recording) end() time.Time {
+	return rec.Start.Add(time.Duration(rec.Duration) * time.Second)
+}
+
+// fileName returns the name of the recording file
+func (rec *recording) fileName() string {
+	return rec.ID + ".ts"
+}
+
+// sources returns the source addresses to record from
+func (rec *recording) sources() []string {
+	if rec.Channel == "" {
+		return []string{rec.Addr}
+	}
+	sources, _ := findChannelSources(rec.Channel)
+	return sources
+}
+
+var (
+	recordings    = map[string]*recording{}
+	recordingLock sync.Mutex
+)
+
+// recordingPath returns the path of a file in the recording directory
+func recordingPath(name string) string {
+	return filepath.Join(getConfig().RecordingDir, name)
+}
+
+// saveRecordings saves the recording list to the index file, the caller
+// must hold 'recordingLock'.
+func saveRecordings() {
+	list := make([]*recording, 0, len(recordings))
+	for _, rec := range recordings {
+		list = append(list, rec)
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		slog.Error(
+			"failed to marshal recordings",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	err = os.WriteFile(recordingPath(recordingIndexFile), data, 0666)
+	if err != nil {
+		slog.Error(
+			"failed to write recording index file",
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// setRecordingStatus updates the status of a recording and saves the list
+func setRecordingStatus(rec *recording, status string, err error) {
+	recordingLock.Lock()
+	defer recordingLock.Unlock()
+
+	rec.Status = status
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if fi, e := os.Stat(recordingPath(rec.fileName())); e == nil {
+		rec.Size = fi.Size()
+	}
+
+	// the recording may have been deleted
+	if recordings[rec.ID] == rec {
+		saveRecordings()
+	}
+}
+
+// recordSource records data from a multicast connection to the file until
+// the context is done or the multicast connection is closed, it returns the
+// number of bytes written and whether the multicast connection is closed.
+func recordSource(ctx context.Context, rec *recording, mc *mcastConn, created bool, f *os.File) (int64, bool, error) {
+	rc := mc.attachClient("recording-"+rec.ID, created)
+	defer mc.detachClient(rc)
+
+	slog.Info(
+		"recording source attached",
+		slog.String("recording", rec.ID),
+		slog.String("multicastAddress", mc.addr),
+	)
+
+	written := int64(0)
+	if len(rc.prelude) > 0 {
+		n, err := f.Write(rc.prelude)
+		written += int64(n)
+		if err != nil {
+			return written, false, err
+		}
+	}
+
+	for {
+		select {
+		case <-rc.ready():
+			n, err := f.Write(rc.read())
+			written += int64(n)
+			if err != nil {
+				return written, false, err
+			}
+		case <-rc.ctx.Done():
+			return written, mc.ctx.Err() != nil, nil
+		case <-ctx.Done():
+			return written, false, nil
+		}
+	}
+}
+
+// record waits until the start time of the recording, and records the data
+// until the end time. For a channel, it switches to the next source if the
+// current source fails.
+func record(ctx context.Context, rec *recording) {
+	defer close(rec.done)
+
+	select {
+	case <-time.After(time.Until(rec.Start)):
+	case <-ctx.Done():
+		setRecordingStatus(rec, recordingCanceled, nil)
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, rec.end())
+	defer cancel()
+
+	setRecordingStatus(rec, recordingRunning, nil)
+	slog.Info("recording started", slog.String("recording", rec.ID))
+
+	// append to the file, in case the recording is resumed after restart
+	path := recordingPath(rec.fileName())
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		slog.Error(
+			"failed to open recording file",
+			slog.String("recording", rec.ID),
+			slog.String("error", err.Error()),
+		)
+		setRecordingStatus(rec, recordingFailed, err)
+		return
+	}
+	defer f.Close()
+
+	sources := rec.sources()
+	if len(sources) == 0 {
+		setRecordingStatus(rec, recordingFailed, errors.New("no source"))
+		return
+	}
+
+	// like the channel relay, we give up after all sources failed without
+	// writing any data, 'joinErr' is the last error of joining a source
+	var joinErr error
+	failed := 0
+	for i := 0; ctx.Err() == nil; i = (i + 1) % len(sources) {
+		if failed >= len(sources) {
+			// wait a while before trying again, the sources may recover
+			select {
+			case <-time.After(time.Duration(getConfig().ReadTimeout) * time.Millisecond):
+			case <-ctx.Done():
+				continue
+			}
+			failed = 0
+		}
+
+		mc, created, err := mcastJoin(sources[i])
+		if err != nil {
+			slog.Warn(
+				"failed to join recording source",
+				slog.String("recording", rec.ID),
+				slog.String("multicastAddress", sources[i]),
+				slog.String("error", err.Error()),
+			)
+			joinErr = err
+			failed++
+			continue
+		}
+
+		n, mcClosed, err := recordSource(ctx, rec, mc, created, f)
+		if err != nil {
+			slog.Error(
+				"failed to write recording file",
+				slog.String("recording", rec.ID),
+				slog.String("error", err.Error()),
+			)
+			setRecordingStatus(rec, recordingFailed, err)
+			return
+		}
+		if !mcClosed {
+			break
+		}
+
+		if n > 0 {
+			failed = 0
+		}
+		failed++
+	}
+
+	status := recordingCompleted
+	if errors.Is(ctx.Err(), context.Canceled) {
+		status = recordingCanceled
+	}
+
+	// the recording failed if nothing is written, including the data written
+	// before a restart
+	if fi, e := f.Stat(); status == recordingCompleted && e == nil && fi.Size() == 0 {
+		status, err = recordingFailed, joinErr
+		if err == nil {
+			err = errors.New("no data received")
+		}
+	}
+
+	setRecordingStatus(rec, status, err)
+	slog.Info(
+		"recording stopped",
+		slog.String("recording", rec.ID),
+		slog.String("status", status),
+	)
+}
+
+// startRecording starts the goroutine of a recording, the caller must hold
+// 'recordingLock'.
+func startRecording(rec *recording) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rec.cancel = cancel
+	rec.done = make(chan struct{})
+	go record(ctx, rec)
+}
+
+// initRecordings loads the recording list from the index file, and resumes
+// the recordings which have not finished.
+func initRecordings() {
+	dir := getConfig().RecordingDir
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		slog.Error(
+			"failed to create recording directory",
+			slog.String("directory", dir),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	data, err := os.ReadFile(recordingPath(recordingIndexFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error(
+				"failed to read recording index file",
+				slog.String("error", err.Error()),
+			)
+		}
+		return
+	}
+
+	var list []*recording
+	if err = json.Unmarshal(data, &list); err != nil {
+		slog.Error(
+			"failed to decode recording index file",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	recordingLock.Lock()
+	defer recordingLock.Unlock()
+
+	now := time.Now()
+	for _, rec := range list {
+		recordings[rec.ID] = rec
+		if rec.Status != recordingScheduled && rec.Status != recordingRunning {
+			continue
+		}
+		if rec.end().After(now) {
+			startRecording(rec)
+		} else {
+			rec.Status = recordingFailed
+			rec.Error = "interrupted"
+		}
+	}
+	saveRecordings()
+}
+
+// apiListRecordings lists all recordings
+func apiListRecordings(w http.ResponseWriter, r *http.Request) {
+	_ = r
+
+	recordingLock.Lock()
+	result := make([]recording, 0, len(recordings))
+	for _, rec := range recordings {
+		result = append(result, *rec)
+	}
+	recordingLock.Unlock()
+
+	// the size of running recordings changes all the time
+	for i := range result {
+		if result[i].Status != recordingRunning {
+			continue
+		}
+		if fi, err := os.Stat(recordingPath(result[i].fileName())); err == nil {
+			result[i].Size = fi.Size()
+		}
+	}
+
+	slices.SortFunc(result, func(a, b recording) int {
+		return b.Start.Compare(a.Start)
+	})
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(result)
+}
+
+// apiCreateRecording creates a recording of a channel or a multicast address
+func apiCreateRecording(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Channel string    `json:"channel"`
+		Addr    string    `json:"addr"`
+		Start   time.Time `json:"start"`
+
+		// Duration is the duration of the recording in second
+		Duration int `json:"duration"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error(
+			"failed to decode request body",
+			slog.String("error", err.Error()),
+		)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if (req.Channel == "") == (req.Addr == "") {
+		http.Error(w, "one of channel and addr is required", http.StatusBadRequest)
+		return
+	}
+	if req.Channel != "" {
+		if _, found := findChannelSources(req.Channel); !found {
+			http.Error(w, "channel not found", http.StatusBadRequest)
+			return
+		}
+	} else if err := validateSource(req.Addr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Duration <= 0 {
+		http.Error(w, "invalid duration", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	if req.Start.IsZero() || req.Start.Before(now) {
+		req.Start = now
+	}
+
+	rec := &recording{
+		Channel:  req.Channel,
+		Addr:     req.Addr,
+		Start:    req.Start,
+		Duration: req.Duration,
+		Status:   recordingScheduled,
+	}
+
+	// the ID must be unique, or the existing recording could no longer be
+	// listed or deleted
+	recordingLock.Lock()
+	for rec.ID == "" || recordings[rec.ID] != nil {
+		rec.ID = fmt.Sprintf("%s-%04x", req.Start.Format("20060102-150405"), rand.IntN(0x10000))
+	}
+	recordings[rec.ID] = rec
+	startRecording(rec)
+	saveRecordings()
+	result := *rec
+	recordingLock.Unlock()
+
+	slog.Info(
+		"recording created",
+		slog.String("recording", rec.ID),
+		slog.String("channel", rec.Channel),
+		slog.String("multicastAddress", rec.Addr),
+	)
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&result)
+}
+
+// apiDownloadRecording downloads the file of a recording, HTTP range requests
+// are supported
+func apiDownloadRecording(w http.ResponseWriter, r *http.Request) {
+	recordingLock.Lock()
+	rec := recordings[r.PathValue("id")]
+	recordingLock.Unlock()
+	if rec == nil {
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(recordingPath(rec.fileName()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := rec.Channel
+	if name == "" {
+		name = rec.Addr
+	}
+	name = fmt.Sprintf("%s-%s.ts", name, rec.Start.Format("20060102-1504"))
+	w.Header().Set("Content-Type", "video/MP2T")
+	w.Header().Set(
+		"Content-Disposition",
+		fmt.Sprintf("attachment; filename*=UTF-8''%s", url.PathEscape(name)),
+	)
+	http.ServeContent(w, r, rec.fileName(), fi.ModTime(), f)
+}
+
+// apiDeleteRecording deletes a recording, it is canceled first if it is
+// scheduled or running
+func apiDeleteRecording(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	recordingLock.Lock()
+	rec := recordings[id]
+	if rec != nil {
+		delete(recordings, id)
+		saveRecordings()
+	}
+	recordingLock.Unlock()
+
+	if rec == nil {
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return
+	}
+
+	// wait for the recording to stop, so that the file won't be created
+	// again after it is removed
+	if rec.cancel != nil {
+		rec.cancel()
+		<-rec.done
+	}
+
+	err := os.Remove(recordingPath(rec.fileName()))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error(
+			"failed to remove recording file",
+			slog.String("recording", id),
+			slog.String("error", err.Error()),
+		)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("recording deleted", slog.String("recording", id))
+}
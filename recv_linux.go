@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchConn is the connection which could read multiple datagrams at once,
+// it is either an ipv4.PacketConn or an ipv6.PacketConn
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchReader reads multiple datagrams from a UDP connection with one
+// recvmmsg system call
+type batchReader struct {
+	conn batchConn
+	msgs []ipv4.Message
+}
+
+// newBatchReader creates a reader which reads at most 'batch' datagrams
+// at once, each datagram is at most 'size' bytes
+func newBatchReader(conn *net.UDPConn, batch, size int) (*batchReader, error) {
+	br := &batchReader{msgs: make([]ipv4.Message, batch)}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		br.conn = ipv6.NewPacketConn(conn)
+	} else {
+		br.conn = ipv4.NewPacketConn(conn)
+	}
+	for i := range br.msgs {
+		br.msgs[i].Buffers = [][]byte{make([]byte, size)}
+	}
+	return br, nil
+}
+
+// read waits for and reads the available datagrams, it returns the number
+// of datagrams read, use 'packet' to get them
+func (br *batchReader) read() (int, error) {
+	return br.conn.ReadBatch(br.msgs, 0)
+}
+
+// packet returns the i-th datagram of the last read, it is only valid before
+// the next read
+func (br *batchReader) packet(i int) []byte {
+	return br.msgs[i].Buffers[0][:br.msgs[i].N]
+}
+
+// setReadBuffer sets the size of the receive buffer of the connection, it
+// tries SO_RCVBUFFORCE first, which ignores the 'rmem_max' limit of the
+// system but requires the CAP_NET_ADMIN capability.
+func setReadBuffer(conn *net.UDPConn, size int) error {
+	err := setsockopt(conn, func(fd int) error {
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, size)
+	})
+	if err != nil {
+		err = conn.SetReadBuffer(size)
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newLoopbackPair creates a UDP connection on the loopback interface and a
+// connection which sends datagrams to it, 'network' is 'udp4' or 'udp6'
+func newLoopbackPair(tb testing.TB, network string) (*net.UDPConn, *net.UDPConn) {
+	ip := net.IPv4(127, 0, 0, 1)
+	if network == "udp6" {
+		ip = net.IPv6loopback
+	}
+	recv, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+	if err != nil {
+		tb.Skip(err)
+	}
+	tb.Cleanup(func() { recv.Close() })
+
+	send, err := net.DialUDP(network, nil, recv.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { send.Close() })
+
+	return recv, send
+}
+
+func TestBatchReader(t *testing.T) {
+	for _, network := range []string{"udp4", "udp6"} {
+		t.Run(network, func(t *testing.T) {
+			testBatchReader(t, network)
+		})
+	}
+}
+
+func testBatchReader(t *testing.T, network string) {
+	recv, send := newLoopbackPair(t, network)
+	br, err := newBatchReader(recv, 16, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// datagrams of different sizes, so that a wrong length is detected
+	var sent [][]byte
+	for i := range 10 {
+		p := bytes.Repeat([]byte{byte(i)}, 100+i*100)
+		if _, err = send.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, p)
+	}
+
+	var received [][]byte
+	for len(received) < len(sent) {
+		n, err := br.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n <= 0 || n > 16 {
+			t.Fatalf("invalid number of datagrams: %d", n)
+		}
+		for i := range n {
+			received = append(received, bytes.Clone(br.packet(i)))
+		}
+	}
+
+	for i := range sent {
+		if !bytes.Equal(received[i], sent[i]) {
+			t.Errorf("datagram %d: got %d bytes, want %d bytes", i, len(received[i]), len(sent[i]))
+		}
+	}
+}
+
+// cpuTime returns the user and system CPU time consumed by the process
+func cpuTime(tb testing.TB) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		tb.Fatal(err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// BenchmarkBatchReader compares reading datagrams one by one with reading
+// them in batches, each iteration sends and receives 16 datagrams of the
+// common IPTV size. Besides the wall time, it reports the CPU time of the
+// process per megabit received, the CPU time of the sending is included, but
+// it is the same for both cases.
+func BenchmarkBatchReader(b *testing.B) {
+	const count = 16
+	pkt := bytes.Repeat([]byte{tsSyncByte}, 7*tsPacketSize)
+
+	for _, batch := range []int{1, 16} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			recv, send := newLoopbackPair(b, "udp4")
+			br, err := newBatchReader(recv, batch, 2048)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			received := int64(0)
+			b.SetBytes(count * int64(len(pkt)))
+			b.ResetTimer()
+			start := cpuTime(b)
+			for range b.N {
+				for range count {
+					if _, err = send.Write(pkt); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for n := 0; n < count; {
+					m, err := br.read()
+					if err != nil {
+						b.Fatal(err)
+					}
+					for i := range m {
+						received += int64(len(br.packet(i)))
+					}
+					n += m
+				}
+			}
+			cpu := cpuTime(b) - start
+			b.StopTimer()
+
+			mbits := float64(received*8) / 1e6
+			b.ReportMetric(float64(cpu.Microseconds())/mbits, "cpu-us/Mbit")
+		})
+	}
+}
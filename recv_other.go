@@ -0,0 +1,40 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// batchReader reads datagrams from a UDP connection, other systems do not
+// have recvmmsg, so it reads one datagram at a time
+type batchReader struct {
+	conn *net.UDPConn
+	buf  []byte
+	n    int
+}
+
+// newBatchReader creates a reader of the connection, 'batch' is ignored
+func newBatchReader(conn *net.UDPConn, batch, size int) (*batchReader, error) {
+	return &batchReader{conn: conn, buf: make([]byte, size)}, nil
+}
+
+// read waits for and reads a datagram, it returns the number of datagrams
+// read, use 'packet' to get it
+func (br *batchReader) read() (int, error) {
+	n, err := br.conn.Read(br.buf)
+	if err != nil {
+		return 0, err
+	}
+	br.n = n
+	return 1, nil
+}
+
+// packet returns the datagram of the last read, it is only valid before the
+// next read
+func (br *batchReader) packet(i int) []byte {
+	return br.buf[:br.n]
+}
+
+// setReadBuffer sets the size of the receive buffer of the connection
+func setReadBuffer(conn *net.UDPConn, size int) error {
+	return conn.SetReadBuffer(size)
+}
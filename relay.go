@@ -3,10 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -61,9 +66,19 @@ func extractPayload(pkt []byte) []byte {
 
 	// add length of extention headers
 	if pkt[0]&0x10 != 0 {
+		if len(pkt) < 16 {
+			slog.Debug("RTP packet too short")
+			return nil
+		}
 		hdrLen += 4 * ((int(pkt[14]) << 8) + int(pkt[14+1]))
 	}
 
+	// no payload
+	if len(pkt) <= hdrLen {
+		slog.Debug("RTP packet too short")
+		return nil
+	}
+
 	// unknown payload
 	if pkt[hdrLen] != SigMPEGTS {
 		slog.Debug("unknown payload")
@@ -84,71 +99,218 @@ func extractPayload(pkt []byte) []byte {
 	return pkt[hdrLen:]
 }
 
-// relayBuffer is a buffer for relaying multicast IPTV channel
-type relayBuffer struct {
-	ref atomic.Int32
-	buf []byte
-}
-
-func newRelayBuffer() *relayBuffer {
-	rb := relayBufPool.Get().(*relayBuffer)
-	rb.ref.Store(1)
-	rb.buf = rb.buf[:0]
-	return rb
+// bitrateMeter measures the bitrate of a stream every second, 'add' should
+// only be called by one goroutine, while 'bitrate' could be called by any
+// goroutine.
+type bitrateMeter struct {
+	start   time.Time
+	bytes   int64
+	rate    atomic.Int64
+	updated atomic.Int64
 }
 
-func (rb *relayBuffer) AddRef() {
-	rb.ref.Add(1)
-}
-
-func (rb *relayBuffer) Release() {
-	if rb.ref.Add(-1) == 0 {
-		relayBufPool.Put(rb)
+func (m *bitrateMeter) add(n int) {
+	now := time.Now()
+	if m.start.IsZero() {
+		m.start = now
+	}
+	m.bytes += int64(n)
+	if elapsed := now.Sub(m.start); elapsed >= time.Second {
+		m.rate.Store(m.bytes * 8 * int64(time.Second) / int64(elapsed))
+		m.updated.Store(now.UnixNano())
+		m.start, m.bytes = now, 0
 	}
 }
 
-// relayBufPool is the buffer pool for relay, to improve performance
-var relayBufPool = sync.Pool{
-	New: func() any {
-		rb := relayBuffer{}
-		rb.buf = make([]byte, 0, getConfig().WriteBufferSize)
-		return &rb
-	},
+// bitrate returns the bitrate in bit per second, it is 0 if no data is added
+// recently
+func (m *bitrateMeter) bitrate() int64 {
+	if time.Since(time.Unix(0, m.updated.Load())) > 2*time.Second {
+		return 0
+	}
+	return m.rate.Load()
 }
 
 type relayClient struct {
 	addr      string
-	ch        chan *relayBuffer
+	userAgent string
 	createdAt time.Time
+	ctx       context.Context
 	cancel    context.CancelFunc
+
+	// player specifies whether the client is a player, e.g. a HTTP relay
+	// client, the connection only lingers after a player leaves, internal
+	// clients like health checks do not keep it.
+	player bool
+
+	// ring is the ring buffer of the connection, 'pos' is the read cursor
+	// of the client, and 'buf' is the buffer to hold the data of a read
+	ring *relayRing
+	pos  atomic.Int64
+	buf  []byte
+
+	// prelude is the PAT and PMTs from the GOP cache, it is set by
+	// 'addClient' and should be sent to the client before the data from
+	// 'read'
+	prelude []byte
+
+	// statistics, 'skipped' is the number of bytes skipped because the
+	// client is too slow, 'skips' is the number of skips, and 'firstByte'
+	// is the time (in nanosecond) from creation to the first read
+	sent      atomic.Int64
+	skipped   atomic.Int64
+	skips     atomic.Int64
+	firstByte atomic.Int64
+	rate      bitrateMeter
+
+	// drops is the number of consecutive skips, it is reset when the client
+	// reads a full ring buffer of data without skipping, 'sinceSkip' is the
+	// size of data read since the last skip, and 'downgraded' is set when
+	// the client is downgraded because of the drops, see
+	// 'Config.StallPolicy' for details.
+	drops      atomic.Int64
+	sinceSkip  int64
+	downgraded atomic.Bool
 }
 
-func (rc *relayClient) send(rb *relayBuffer) {
-	rb.AddRef()
-	select {
-	case rc.ch <- rb:
-	default:
+// ready returns a channel which is closed when there is data to read
+func (rc *relayClient) ready() <-chan struct{} {
+	return rc.ring.ready(rc.pos.Load())
+}
+
+// read returns the data at the cursor of the client and advances the
+// cursor, the data is only valid before the next read.
+func (rc *relayClient) read() []byte {
+	n, pos, skipped := rc.ring.read(rc.pos.Load(), rc.buf)
+	if skipped > 0 {
+		rc.skipped.Add(skipped)
+		rc.skips.Add(1)
+		rc.drops.Add(1)
+		rc.sinceSkip = 0
 		slog.Debug(
-			"write buffer full, packets discarded",
+			"client is too slow, packets skipped",
 			slog.String("address", rc.addr),
-			slog.Int("dataSize", len(rb.buf)),
+			slog.Int64("dataSize", skipped),
 		)
-		rb.Release()
+	}
+	rc.pos.Store(pos)
+	// a client keeping pace with the stream reads a full ring buffer before
+	// it is overwritten, while a slower one skips again
+	rc.sinceSkip += int64(n)
+	if rc.sinceSkip >= int64(len(rc.ring.buf)) {
+		rc.drops.Store(0)
+	}
+
+	if n > 0 {
+		if rc.firstByte.Load() == 0 {
+			rc.firstByte.Store(int64(time.Since(rc.createdAt)))
+		}
+		rc.sent.Add(int64(n))
+		rc.rate.add(n)
+	}
+	return rc.buf[:n]
+}
+
+// live skips the prelude and the data before the latest committed data, so
+// that the client only receives the data received from now on
+func (rc *relayClient) live() {
+	rc.prelude = nil
+	rc.pos.Store(rc.ring.live())
+}
+
+// lag returns the number of bytes committed but not read by the client
+func (rc *relayClient) lag() int64 {
+	return max(rc.ring.live()-rc.pos.Load(), 0)
+}
+
+// relayInput is the input of a relay connection, it receives the stream
+// from a source and writes it to the connection
+type relayInput interface {
+	// receive receives the stream and writes it to the connection by 'write'
+	// or 'writePacket', it returns when the source fails, all clients are
+	// gone or the connection is canceled.
+	receive(mc *mcastConn)
+
+	// close releases the resources of the input
+	close()
+}
+
+// validateSource checks the address of a source without connecting to it,
+// the address is a multicast address, a HTTP or RTSP URL, or a 'file:'
+// source.
+func validateSource(addr string) error {
+	switch {
+	case isUnicastSource(addr):
+		u, err := url.Parse(addr)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "rtsp") {
+			return errInvalidMcastAddr
+		}
+	case isFileSource(addr):
+		if !filepath.IsLocal(strings.TrimPrefix(addr, "file:")) {
+			return errInvalidMcastAddr
+		}
+	default:
+		if _, _, err := parseMcastAddr(addr); err != nil {
+			return errInvalidMcastAddr
+		}
+	}
+	return nil
+}
+
+// newRelayInput creates the input of a source address
+func newRelayInput(addr string) (relayInput, error) {
+	switch {
+	case isUnicastSource(addr):
+		return newUpstreamInput(addr)
+	case isFileSource(addr):
+		return newFileInput(addr)
+	default:
+		return newMcastInput(addr)
 	}
 }
 
 type mcastConn struct {
 	addr       string
-	conn       *net.UDPConn
+	input      relayInput
 	createdAt  time.Time
 	clientLock sync.Mutex
 	clients    []*relayClient
-	ctx        context.Context
-	cancel     context.CancelFunc
+
+	// idleSince is the time when the last client left, it is zero if the
+	// connection has clients, 'playerLeft' is the time when the last player
+	// left, and 'reused' is the number of times a player is attached during
+	// the linger period. All are protected by 'clientLock'.
+	idleSince  time.Time
+	playerLeft time.Time
+	reused     int
+	rtp        *rtpReorderBuffer
+	psi        *tsPSIParser
+	ring       *relayRing
+	tserr      *tsErrorAnalyzer
+
+	// statistics of the input, 'firstData' is the time (in nanosecond) from
+	// creation to the first data received
+	received  atomic.Int64
+	firstData atomic.Int64
+	rate      bitrateMeter
+
+	// stalls is the number of times the stall policy is applied to the
+	// clients, see 'Config.StallPolicy'
+	stalls atomic.Int64
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 var mcastConns = sync.Map{}
 
+// lingerStats is the statistics of the linger periods of all connections
+var lingerStats struct {
+	started atomic.Int64
+	reused  atomic.Int64
+	expired atomic.Int64
+}
+
 func (mc *mcastConn) getClients() []*relayClient {
 	mc.clientLock.Lock()
 	defer mc.clientLock.Unlock()
@@ -157,16 +319,38 @@ func (mc *mcastConn) getClients() []*relayClient {
 	return result
 }
 
-func (mc *mcastConn) addClient(rc *relayClient) {
+// addClient adds the client to the connection, a player is rejected if the
+// client limit of the group is reached, internal clients are never rejected,
+// but they are counted.
+func (mc *mcastConn) addClient(rc *relayClient) error {
 	mc.clientLock.Lock()
 	defer mc.clientLock.Unlock()
+
+	if rc.player {
+		if err := checkClientLimit(mc); err != nil {
+			return err
+		}
+	}
+
+	var pos int64
+	rc.prelude, pos = mc.ring.start()
+	rc.pos.Store(pos)
+	if !mc.idleSince.IsZero() {
+		mc.idleSince = time.Time{}
+		if rc.player {
+			mc.reused++
+			lingerStats.reused.Add(1)
+			slog.Info("lingering relay connection reused", slog.String("address", mc.addr))
+		}
+	}
 	for i, c := range mc.clients {
 		if c == nil {
 			mc.clients[i] = rc
-			return
+			return nil
 		}
 	}
 	mc.clients = append(mc.clients, rc)
+	return nil
 }
 
 func (mc *mcastConn) closeClient(addr string) {
@@ -180,101 +364,180 @@ func (mc *mcastConn) closeClient(addr string) {
 	}
 }
 
-func (mc *mcastConn) removeClient(addr string) {
+// removeClient removes the client, it is matched by identity instead of
+// address, as internal clients of the same kind share an address
+func (mc *mcastConn) removeClient(client *relayClient) {
 	mc.clientLock.Lock()
 	defer mc.clientLock.Unlock()
 	for i, rc := range mc.clients {
-		if rc != nil && rc.addr == addr {
+		if rc == client {
 			mc.clients[i] = nil
+			if rc.player {
+				mc.playerLeft = time.Now()
+			}
 			break
 		}
 	}
 }
 
-func (mc *mcastConn) sendToClients(rb *relayBuffer) int {
-	count := 0
-	mc.clientLock.Lock()
-	defer mc.clientLock.Unlock()
-	for _, rc := range mc.clients {
-		if rc != nil {
-			rc.send(rb)
-			count++
-		}
+// attachClient creates a client with the address and adds it to the multicast
+// connection, it also starts the 'receive' goroutine if the connection is
+// newly created. The caller must call 'detachClient' when it is done. It is
+// for internal clients, which are never rejected by the client limit.
+func (mc *mcastConn) attachClient(addr string, created bool) *relayClient {
+	rc := mc.newClient(addr)
+	mc.attach(rc, created)
+	return rc
+}
+
+// newClient creates a client of the multicast connection, the client is not
+// attached, so its fields could be set before calling 'attach'
+func (mc *mcastConn) newClient(addr string) *relayClient {
+	// reads end at packet boundaries, so a skip never splits a packet
+	size := max(getConfig().WriteBufferSize/tsPacketSize, 1) * tsPacketSize
+
+	ctx, cancel := context.WithCancel(mc.ctx)
+	rc := &relayClient{
+		addr:      addr,
+		createdAt: time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+		ring:      mc.ring,
+		buf:       make([]byte, size),
 	}
-	return count
+	return rc
 }
 
-func (mc *mcastConn) setReadDeadline() {
-	to := time.Duration(getConfig().ReadTimeout) * time.Millisecond
-	mc.conn.SetReadDeadline(time.Now().Add(to))
+// attach adds a client created by 'newClient' to the multicast connection,
+// see 'attachClient' for details. It returns 'errLimitExceeded' if the client
+// is a player and the client limit of the group is reached, the 'receive'
+// goroutine is still started in this case, so that the connection is closed
+// as an idle one.
+func (mc *mcastConn) attach(rc *relayClient, created bool) error {
+	err := mc.addClient(rc)
+	if err != nil {
+		rc.cancel()
+	}
+
+	if created {
+		// in this case, must call addClient before receive, or the receive
+		// goroutine may exit immediately because there is no client
+		go mc.receive()
+	}
+	return err
 }
 
-func (mc *mcastConn) receive(bufSize int) {
-	rbuf := make([]byte, bufSize)
-	wbuf := newRelayBuffer()
-	mc.setReadDeadline()
+// detachClient removes the client from the multicast connection
+func (mc *mcastConn) detachClient(rc *relayClient) {
+	mc.removeClient(rc)
+	rc.cancel()
+}
 
-LOOP:
-	for {
-		n, err := mc.conn.Read(rbuf)
-		if err != nil {
-			slog.Error(
-				"failed to read from multicast connection",
-				slog.String("address", mc.addr),
-				slog.String("error", err.Error()),
-			)
-			break
+// checkIdle checks whether the connection should be closed because all
+// clients are gone. The connection is kept for the linger time after the
+// last player leaves, so that a player reconnecting soon could reuse it,
+// it is closed at once if only internal clients used it.
+func (mc *mcastConn) checkIdle() bool {
+	mc.clientLock.Lock()
+	defer mc.clientLock.Unlock()
+
+	for _, rc := range mc.clients {
+		if rc != nil {
+			return true
 		}
-		if n == 0 {
-			continue
+	}
+
+	// 'playerLeft' is zero if no player ever left, so the connection is
+	// closed at once in this case
+	now := time.Now()
+	linger := time.Duration(getConfig().RelayLinger) * time.Second
+	if linger <= 0 || now.Sub(mc.playerLeft) >= linger {
+		if !mc.idleSince.IsZero() {
+			lingerStats.expired.Add(1)
 		}
+		return false
+	}
 
-		p := extractPayload(rbuf[:n])
+	if mc.idleSince.IsZero() {
+		mc.idleSince = now
+		lingerStats.started.Add(1)
+	}
+	return true
+}
 
-		if len(wbuf.buf)+len(p) > cap(wbuf.buf) {
-			if mc.sendToClients(wbuf) == 0 {
-				// all clients are gone
-				break
-			}
-			wbuf.Release()
-			wbuf = newRelayBuffer()
-			mc.setReadDeadline()
-		}
+// write writes a payload to the ring buffer, the clients are notified when
+// a chunk of data is committed, it returns false if all clients are gone
+// and the linger time is over.
+func (mc *mcastConn) write(p []byte) bool {
+	if mc.firstData.Load() == 0 {
+		mc.firstData.Store(int64(time.Since(mc.createdAt)))
+	}
+	mc.received.Add(int64(len(p)))
+	mc.rate.add(len(p))
 
-		wbuf.buf = append(wbuf.buf, p...)
+	mc.tserr.handle(p)
+	tsForEachPacket(p, mc.psi.handlePacket)
+	if mc.ring.write(p, mc.psi) {
+		return mc.checkIdle()
+	}
+	return true
+}
 
-		select {
-		case <-mc.ctx.Done():
-			break LOOP
-		default:
+// writePacket writes a packet received from the source, which is either a
+// RTP packet or MPEG-TS packets, it returns false if all clients are gone.
+func (mc *mcastConn) writePacket(pkt []byte) bool {
+	alive := true
+	write := func(p []byte) {
+		if alive {
+			alive = mc.write(p)
 		}
 	}
 
+	if seq, ok := rtpSequence(pkt); ok {
+		mc.rtp.push(seq, extractPayload(pkt), write)
+	} else {
+		write(extractPayload(pkt))
+	}
+	return alive
+}
+
+// close removes the connection from the connection list and releases its
+// resources, it is called when the receiving goroutine exits
+func (mc *mcastConn) close() {
 	mcastConns.Delete(mc.addr)
 	mc.cancel()
-	wbuf.Release()
-	mc.conn.Close()
-	slog.Info("multicast connection closed", slog.String("address", mc.addr))
+	mc.tserr.flush()
+	mc.input.close()
+	if bitrate := mc.rate.bitrate(); bitrate > 0 {
+		knownBitrates.Store(mc.addr, bitrate)
+	}
+	slog.Info("relay connection closed", slog.String("address", mc.addr))
 }
 
-// mcastConnect establishes a connection according to the request
-func mcastConnect(w http.ResponseWriter, r *http.Request) (*mcastConn, bool) {
-	addr := r.PathValue("addr")
-	if v, _ := mcastConns.Load(addr); v != nil {
-		return v.(*mcastConn), false
-	}
+// receive receives the stream from the input until it returns, and then
+// closes the connection
+func (mc *mcastConn) receive() {
+	mc.input.receive(mc)
+	mc.close()
+}
 
-	ap, err := netip.ParseAddrPort(addr)
+// mcastInput receives the stream from a multicast group
+type mcastInput struct {
+	conn   *net.UDPConn
+	reader *batchReader
+}
+
+// newMcastInput joins the multicast group of the address
+func newMcastInput(addr string) (*mcastInput, error) {
+	source, ap, err := parseMcastAddr(addr)
 	if err != nil {
 		slog.Error(
 			"failed to parse multicast address",
 			slog.String("address", addr),
 			slog.String("error", err.Error()),
 		)
-		http.Error(w, "invalid multicast address", http.StatusBadRequest)
-		return nil, false
+		return nil, errInvalidMcastAddr
 	}
-	udpAddr := net.UDPAddrFromAddrPort(ap)
 
 	cfg := getConfig()
 	iface, err := net.InterfaceByName(cfg.McastIface)
@@ -284,120 +547,408 @@ func mcastConnect(w http.ResponseWriter, r *http.Request) (*mcastConn, bool) {
 			slog.String("interface", cfg.McastIface),
 			slog.String("error", err.Error()),
 		)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return nil, false
+		return nil, err
 	}
 
-	conn, err := net.ListenMulticastUDP("udp", iface, udpAddr)
+	conn, err := listenMulticast(iface, net.UDPAddrFromAddrPort(ap), source)
 	if err != nil {
 		slog.Error(
 			"failed to listen to multicast address",
 			slog.String("address", addr),
 			slog.String("error", err.Error()),
 		)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return nil, false
+		return nil, err
+	}
+
+	if cfg.McastRecvBuffer > 0 {
+		if err = setReadBuffer(conn, cfg.McastRecvBuffer); err != nil {
+			slog.Warn(
+				"failed to set receive buffer size",
+				slog.String("address", addr),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
+	reader, err := newBatchReader(conn, cfg.McastBatchSize, cfg.McastPacketSize)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &mcastInput{conn: conn, reader: reader}, nil
+}
+
+func (in *mcastInput) receive(mc *mcastConn) {
+	cfg := getConfig()
+
+	// the read deadline is extended when it is about to expire, instead of
+	// before every read, to reduce the overhead
+	timeout := time.Duration(cfg.ReadTimeout) * time.Millisecond
+	deadline := time.Now().Add(timeout)
+	in.conn.SetReadDeadline(deadline)
+
+	for mc.ctx.Err() == nil {
+		n, err := in.reader.read()
+		if err != nil {
+			slog.Error(
+				"failed to read from multicast connection",
+				slog.String("address", mc.addr),
+				slog.String("error", err.Error()),
+			)
+			return
+		}
+
+		for i := range n {
+			pkt := in.reader.packet(i)
+			if len(pkt) > 0 && !mc.writePacket(pkt) {
+				// all clients are gone
+				return
+			}
+		}
+
+		if now := time.Now(); deadline.Sub(now) < timeout*3/4 {
+			deadline = now.Add(timeout)
+			in.conn.SetReadDeadline(deadline)
+		}
+	}
+}
+
+func (in *mcastInput) close() {
+	in.conn.Close()
+}
+
+// errInvalidMcastAddr is returned by mcastJoin if the address is invalid
+var errInvalidMcastAddr = errors.New("invalid multicast address")
+
+// parseMcastAddr parses a multicast address, which is 'group:port', or
+// 'source@group:port' for source-specific multicast. The returned source
+// address is invalid (the zero value) for any-source multicast.
+func parseMcastAddr(addr string) (netip.Addr, netip.AddrPort, error) {
+	var source netip.Addr
+
+	if src, group, found := strings.Cut(addr, "@"); found {
+		var err error
+		if source, err = netip.ParseAddr(src); err != nil {
+			return source, netip.AddrPort{}, err
+		}
+		addr = group
+	}
+
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return source, ap, err
+	}
+	if !ap.Addr().IsMulticast() {
+		return source, ap, errors.New("not a multicast address")
+	}
+	if source.IsValid() && source.Is4() != ap.Addr().Is4() {
+		return source, ap, errors.New("source and group are of different address families")
+	}
+	return source, ap, nil
+}
+
+// mcastJoin joins the multicast group of the address, or returns the existing
+// connection of the address. The returned bool is true if the connection is
+// newly created, the caller should start its 'receive' goroutine in this case.
+// If the address is a HTTP or RTSP URL, or a local file, the connection
+// receives the stream from it instead. An error wrapping 'errLimitExceeded'
+// is returned if a new connection would exceed the limits.
+func mcastJoin(addr string) (*mcastConn, bool, error) {
+	if v, _ := mcastConns.Load(addr); v != nil {
+		return v.(*mcastConn), false, nil
+	}
+
+	joinLock.Lock()
+	defer joinLock.Unlock()
+
+	if v, _ := mcastConns.Load(addr); v != nil {
+		return v.(*mcastConn), false, nil
+	}
+
+	if err := checkJoinLimits(addr); err != nil {
+		return nil, false, err
 	}
 
+	input, err := newRelayInput(addr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	cfg := getConfig()
 	ctx, cancel := context.WithCancel(context.Background())
 	mc := &mcastConn{
 		addr:      addr,
-		conn:      conn,
+		input:     input,
 		createdAt: time.Now(),
+		rtp:       newRTPReorderBuffer(cfg.RTPReorderWindow),
+		psi:       newTSPSIParser(),
+		ring:      newRelayRing(cfg.RelayBufferSize, cfg.WriteBufferSize, newTSGOPCache(cfg.GOPCacheSize)),
+		tserr:     newTSErrorAnalyzer(addr),
 		ctx:       ctx,
 		cancel:    cancel,
 	}
 
-	// reuse existing connection if any
-	if v, ok := mcastConns.LoadOrStore(addr, mc); ok {
-		conn.Close()
-		cancel()
-		return v.(*mcastConn), false
+	mcastConns.Store(addr, mc)
+	slog.Info("relay connection established", slog.String("address", addr))
+	return mc, true, nil
+}
+
+// mcastConnect establishes a connection according to the request
+func mcastConnect(w http.ResponseWriter, r *http.Request) (*mcastConn, bool) {
+	addr := r.PathValue("addr")
+	if isUnicastSource(addr) && !isChannelSource(addr) {
+		http.Error(w, "source is not configured in any channel", http.StatusForbidden)
+		return nil, false
 	}
 
-	slog.Info("multicast connection established", slog.String("address", addr))
-	return mc, true
+	mc, created, err := mcastJoin(addr)
+	if errors.Is(err, errInvalidMcastAddr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if errors.Is(err, errLimitExceeded) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return mc, created
 }
 
-// iptvRelayrelays a multicast IPTV channel to HTTP
-func iptvRelay(w http.ResponseWriter, r *http.Request) {
-	mc, created := mcastConnect(w, r)
-	if mc == nil {
-		return
+// relayToClient relays the data of a multicast connection to a HTTP client,
+// it returns the number of bytes written to the client, and whether the
+// multicast connection is closed, in which case the client is still alive
+// and the caller may switch it to another connection. Only the selected
+// program is relayed if 'sel' is not nil. It returns 'errLimitExceeded' if
+// the client limit of the group is reached, nothing is written in this case.
+func relayToClient(mc *mcastConn, created bool, sel *tsProgramSelector, w http.ResponseWriter, r *http.Request) (int64, bool, error) {
+	rc := mc.newClient(r.RemoteAddr)
+	rc.userAgent = r.UserAgent()
+	rc.player = true
+	if err := mc.attach(rc, created); err != nil {
+		return 0, false, err
 	}
-
-	ch := make(chan *relayBuffer, 16)
-	ctx, cancel := context.WithCancel(mc.ctx)
-	mc.addClient(&relayClient{
-		addr:      r.RemoteAddr,
-		ch:        ch,
-		createdAt: time.Now(),
-		cancel:    cancel,
-	})
 	slog.Info(
 		"relay client added",
 		slog.String("multicastAddress", mc.addr),
 		slog.String("clientAddress", r.RemoteAddr),
 	)
 
-	if created {
-		// in this case, must call addClient before receive, or the receive
-		// goroutine may exit immediately because there is no client
-		go mc.receive(getConfig().McastPacketSize)
+	written := int64(0)
+	mcClosed := false
+
+	cfg := getConfig()
+	ctrl := http.NewResponseController(w)
+	var (
+		filter   *tsKeyframeFilter
+		dropping bool
+		program  *tsProgramFilter
+	)
+	if sel != nil {
+		program = newTSProgramFilter(sel, mc.addr)
 	}
 
-	w.Header().Set("Content-Type", "video/MP2T")
-RELAY_LOOP:
-	for {
-		select {
-		case rb := <-ch:
-			_, err := w.Write(rb.buf)
-			rb.Release()
-			if err != nil {
-				errstr := err.Error()
-				if !strings.HasSuffix(errstr, " write: broken pipe") {
-					slog.Error(
-						"failed to write to client",
-						slog.String("multicastAddress", mc.addr),
-						slog.String("error", errstr),
-					)
-				}
-				break RELAY_LOOP
-			}
-		case <-ctx.Done():
-			break RELAY_LOOP
+	// stalled logs and applies the decision about a stalled client, it
+	// returns false if the client should be disconnected
+	stalled := func(reason, decision string) bool {
+		mc.stalls.Add(1)
+		slog.Warn(
+			"relay client stalled",
+			slog.String("multicastAddress", mc.addr),
+			slog.String("clientAddress", r.RemoteAddr),
+			slog.String("reason", reason),
+			slog.String("decision", decision),
+			slog.Int64("skipped", rc.skipped.Load()),
+		)
+		switch decision {
+		case stallPolicyDrop:
+			return true
+		case stallPolicyDowngrade:
+			rc.downgraded.Store(true)
+			filter = newTSKeyframeFilter()
+			return true
 		}
+		return false
 	}
 
-	mc.removeClient(r.RemoteAddr)
-	cancel()
+	// write writes data to the client, it returns false if failed
+	write := func(data []byte) bool {
+		if cfg.ClientWriteTimeout > 0 {
+			timeout := time.Duration(cfg.ClientWriteTimeout) * time.Millisecond
+			ctrl.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		n, err := w.Write(data)
+		written += int64(n)
+		if err == nil {
+			return true
+		}
+		// the connection is not usable after a write times out, so the
+		// client is always disconnected in this case
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return stalled("write timeout", stallPolicyDisconnect)
+		}
+		errstr := err.Error()
+		if !strings.HasSuffix(errstr, " write: broken pipe") {
+			slog.Error(
+				"failed to write to client",
+				slog.String("multicastAddress", mc.addr),
+				slog.String("error", errstr),
+			)
+		}
+		return false
+	}
+
+	if program != nil {
+		rc.prelude = program.filter(rc.prelude)
+	}
+	alive := len(rc.prelude) == 0 || write(rc.prelude)
+	rc.prelude = nil
 
-	// drain the channel to release all buffers.
-	// we can close the channel here (in the reader goroutine) because we
-	// are sure that there is no writer goroutine anymore.
-	close(ch)
-	for rb := range ch {
-		rb.Release()
+	for alive {
+		select {
+		case <-rc.ready():
+			data := rc.read()
+			// the policy is applied once for each run of consecutive drops,
+			// and a downgraded client is not downgraded again
+			if rc.drops.Load() < int64(cfg.StallDrops) {
+				dropping = false
+			} else if !dropping && filter == nil {
+				dropping = true
+				alive = stalled("too many drops", cfg.StallPolicy)
+			}
+			if program != nil {
+				data = program.filter(data)
+			}
+			if filter != nil {
+				data = filter.filter(data)
+			}
+			alive = alive && (len(data) == 0 || write(data))
+		case <-rc.ctx.Done():
+			mcClosed = mc.ctx.Err() != nil
+			alive = false
+		case <-r.Context().Done():
+			alive = false
+		}
 	}
 
+	mc.detachClient(rc)
+
 	slog.Info(
 		"relay client removed",
 		slog.String("multicastAddress", mc.addr),
 		slog.String("clientAddress", r.RemoteAddr),
 	)
+
+	return written, mcClosed, nil
+}
+
+// iptvRelay relays a multicast IPTV channel to HTTP, if query parameter
+// 'offset' is a negative number of seconds, the channel is relayed from the
+// timeshift buffer.
+func iptvRelay(w http.ResponseWriter, r *http.Request) {
+	if s := r.URL.Query().Get("offset"); s != "" {
+		offset, err := strconv.Atoi(s)
+		if err != nil || offset > 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		if offset < 0 {
+			iptvTimeshift(w, r, offset)
+			return
+		}
+	}
+
+	sel, err := parseProgramSelector(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// HTTP sources which are not MPEG TS streams are passed through
+	addr := r.PathValue("addr")
+	if isNonTSSource(addr) && isChannelSource(addr) {
+		http.Redirect(w, r, addr, http.StatusFound)
+		return
+	}
+
+	mc, created := mcastConnect(w, r)
+	if mc == nil {
+		return
+	}
+
+	// the program could only be checked if the stream information is
+	// available, that's, the connection is not newly created
+	if sel != nil && !created {
+		if info := mc.psi.getInfo(); info != nil && sel.find(info) == nil {
+			http.Error(w, "program not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "video/MP2T")
+	n, mcClosed, err := relayToClient(mc, created, sel, w, r)
+	if err != nil {
+		w.Header().Del("Content-Type")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// nothing is written yet if the upstream is found not to be a MPEG TS
+	// stream, so the client could still be redirected to it
+	if n == 0 && mcClosed && isNonTSSource(addr) {
+		w.Header().Del("Content-Type")
+		http.Redirect(w, r, addr, http.StatusFound)
+	}
 }
 
 // apiListRelays lists all connections and clients
 func apiListRelays(w http.ResponseWriter, r *http.Request) {
+	// the unit of 'Bitrate' is bit per second, 'Lag' is the number of bytes
+	// waiting to be sent, and 'TTFB' is the time to first byte in
+	// millisecond
 	type Client struct {
-		Addr      string    `json:"addr"`
-		CreatedAt time.Time `json:"createdAt"`
+		Addr       string    `json:"addr"`
+		UserAgent  string    `json:"userAgent,omitempty"`
+		CreatedAt  time.Time `json:"createdAt"`
+		Sent       int64     `json:"sent"`
+		Bitrate    int64     `json:"bitrate"`
+		Skipped    int64     `json:"skipped"`
+		Skips      int64     `json:"skips"`
+		Lag        int64     `json:"lag"`
+		TTFB       int64     `json:"ttfb"`
+		Drops      int64     `json:"drops"`
+		Downgraded bool      `json:"downgraded"`
+	}
+
+	type RTP struct {
+		Received   uint64 `json:"received"`
+		Lost       uint64 `json:"lost"`
+		Duplicated uint64 `json:"duplicated"`
+		Reordered  uint64 `json:"reordered"`
+	}
+
+	// the unit of 'PCRJitter' is microsecond
+	type TSErrors struct {
+		Packets    uint64 `json:"packets"`
+		CCErrors   uint64 `json:"ccErrors"`
+		TEIErrors  uint64 `json:"teiErrors"`
+		SyncErrors uint64 `json:"syncErrors"`
+		PCRErrors  uint64 `json:"pcrErrors"`
+		PCRJitter  int64  `json:"pcrJitter"`
 	}
 
 	type Conn struct {
-		Addr      string    `json:"addr"`
-		CreatedAt time.Time `json:"createdAt"`
-		Clients   []Client  `json:"clients"`
+		Addr      string     `json:"addr"`
+		CreatedAt time.Time  `json:"createdAt"`
+		Received  int64      `json:"received"`
+		Bitrate   int64      `json:"bitrate"`
+		Skipped   int64      `json:"skipped"`
+		Skips     int64      `json:"skips"`
+		TTFB      int64      `json:"ttfb"`
+		Stalls    int64      `json:"stalls"`
+		RTP       *RTP       `json:"rtp,omitempty"`
+		TSErrors  TSErrors   `json:"tsErrors"`
+		IdleSince *time.Time `json:"idleSince,omitempty"`
+		Reused    int        `json:"reused"`
+		Clients   []Client   `json:"clients"`
 	}
 
 	result := make([]Conn, 0, 8)
@@ -406,16 +957,58 @@ func apiListRelays(w http.ResponseWriter, r *http.Request) {
 		conn := Conn{
 			Addr:      mc.addr,
 			CreatedAt: mc.createdAt,
+			Received:  mc.received.Load(),
+			Bitrate:   mc.rate.bitrate(),
+			Skipped:   mc.ring.skipped.Load(),
+			Skips:     mc.ring.skips.Load(),
+			TTFB:      time.Duration(mc.firstData.Load()).Milliseconds(),
+			Stalls:    mc.stalls.Load(),
 			Clients:   make([]Client, 0, 4),
 		}
 
+		if st := &mc.rtp.stats; st.received.Load() > 0 {
+			conn.RTP = &RTP{
+				Received:   st.received.Load(),
+				Lost:       st.lost.Load(),
+				Duplicated: st.duplicated.Load(),
+				Reordered:  st.reordered.Load(),
+			}
+		}
+
+		st := &mc.tserr.stats
+		conn.TSErrors = TSErrors{
+			Packets:    st.packets.Load(),
+			CCErrors:   st.ccErrors.Load(),
+			TEIErrors:  st.teiErrors.Load(),
+			SyncErrors: st.syncErrors.Load(),
+			PCRErrors:  st.pcrErrors.Load(),
+			PCRJitter:  st.pcrJitter.Load(),
+		}
+
+		mc.clientLock.Lock()
+		if !mc.idleSince.IsZero() {
+			idleSince := mc.idleSince
+			conn.IdleSince = &idleSince
+		}
+		conn.Reused = mc.reused
+		mc.clientLock.Unlock()
+
 		for _, rc := range mc.getClients() {
 			if rc == nil {
 				continue
 			}
 			conn.Clients = append(conn.Clients, Client{
-				Addr:      rc.addr,
-				CreatedAt: rc.createdAt,
+				Addr:       rc.addr,
+				UserAgent:  rc.userAgent,
+				CreatedAt:  rc.createdAt,
+				Sent:       rc.sent.Load(),
+				Bitrate:    rc.rate.bitrate(),
+				Skipped:    rc.skipped.Load(),
+				Skips:      rc.skips.Load(),
+				Lag:        rc.lag(),
+				TTFB:       time.Duration(rc.firstByte.Load()).Milliseconds(),
+				Drops:      rc.drops.Load(),
+				Downgraded: rc.downgraded.Load(),
 			})
 		}
 
@@ -427,6 +1020,28 @@ func apiListRelays(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
+// apiGetLingerStats returns the statistics of the linger periods of all
+// relay connections, that's, how many times a linger period is started, how
+// many of them are reused by a new client, and how many of them are expired
+func apiGetLingerStats(w http.ResponseWriter, r *http.Request) {
+	_ = r
+
+	result := struct {
+		Linger  int   `json:"linger"`
+		Started int64 `json:"started"`
+		Reused  int64 `json:"reused"`
+		Expired int64 `json:"expired"`
+	}{
+		Linger:  max(getConfig().RelayLinger, 0),
+		Started: lingerStats.started.Load(),
+		Reused:  lingerStats.reused.Load(),
+		Expired: lingerStats.expired.Load(),
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(&result)
+}
+
 // apiCloseRelayConnection closes a relay connection (multicast connection),
 // this will also close all of its clients
 func apiCloseRelayConnection(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// closedChan is a closed channel, it is returned by 'ready' when there is
+// data to read
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// relayRing is the ring buffer shared by all clients of a relay connection.
+// The data is written by the receiving goroutine, and each client reads it
+// with its own cursor, positions are absolute offsets in the stream. The
+// written data is committed (visible to clients) in chunks to reduce the
+// wakeups of the clients.
+type relayRing struct {
+	lock       sync.RWMutex
+	buf        []byte
+	commitSize int64
+	written    int64
+	committed  int64
+	gop        *tsGOPCache
+
+	// skipped and skips are the total number of bytes skipped by slow
+	// clients and the number of skips
+	skipped atomic.Int64
+	skips   atomic.Int64
+
+	// notify is closed and replaced when data is committed
+	notify chan struct{}
+}
+
+func newRelayRing(size, commitSize int, gop *tsGOPCache) *relayRing {
+	return &relayRing{
+		buf:        make([]byte, size),
+		commitSize: int64(commitSize),
+		gop:        gop,
+		notify:     make(chan struct{}),
+	}
+}
+
+// write writes data to the ring buffer, and commits the data if the size of
+// the uncommitted data reaches 'commitSize', it returns true in this case.
+func (r *relayRing) write(p []byte, psi *tsPSIParser) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	off := int(r.written % int64(len(r.buf)))
+	n := copy(r.buf[off:], p)
+	copy(r.buf, p[n:])
+	r.gop.update(p, r.written, psi)
+	r.written += int64(len(p))
+
+	if r.written-r.committed < r.commitSize {
+		return false
+	}
+	r.committed = r.written
+	close(r.notify)
+	r.notify = make(chan struct{})
+	return true
+}
+
+// start returns the prelude and the start position of a new client, see
+// 'tsGOPCache.snapshot' for details.
+func (r *relayRing) start() ([]byte, int64) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	prelude, pos := r.gop.snapshot(r.committed)
+	if pos < r.written-int64(len(r.buf)) {
+		return nil, r.committed
+	}
+	return prelude, pos
+}
+
+// live returns the position of the latest committed data
+func (r *relayRing) live() int64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.committed
+}
+
+// ready returns a channel which is closed when there is data to read at
+// the position
+func (r *relayRing) ready(pos int64) <-chan struct{} {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if pos < r.committed {
+		return closedChan
+	}
+	return r.notify
+}
+
+// read copies the committed data at the position to 'p', it returns the
+// number of bytes copied, the position of the next read, and the number of
+// bytes skipped. If the data at the position has been overwritten, that's,
+// the reader is too slow, it skips to the latest key frame, or the latest
+// committed data if the key frame is not available.
+func (r *relayRing) read(pos int64, p []byte) (int, int64, int64) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	skipped := int64(0)
+	if oldest := r.written - int64(len(r.buf)); pos < oldest {
+		next := r.committed
+		if kf := r.gop.keyframe; kf >= oldest && kf > pos {
+			next = kf
+		}
+		skipped, pos = next-pos, next
+		r.skipped.Add(skipped)
+		r.skips.Add(1)
+	}
+
+	n := int(min(r.committed-pos, int64(len(p))))
+	if n <= 0 {
+		return 0, pos, skipped
+	}
+	off := int(pos % int64(len(r.buf)))
+	m := copy(p[:n], r.buf[off:])
+	copy(p[m:n], r.buf)
+	return n, pos + int64(n), skipped
+}
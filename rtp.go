@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+const (
+	// rtpMaxDropout is the max number of packets could be lost before we
+	// regard the sequence number jump as a restart of the sender
+	rtpMaxDropout = 3000
+
+	// rtpMaxMisorder is the max number of packets a packet could be late
+	// before we regard the sequence number jump as a restart of the sender
+	rtpMaxMisorder = 100
+)
+
+// rtpSequence returns the sequence number of a RTP packet, the returned bool
+// is false if the packet is not a RTP packet.
+func rtpSequence(pkt []byte) (uint16, bool) {
+	if len(pkt) < 12 || pkt[0] == tsSyncByte || pkt[0]&0xC0 != 0x80 {
+		return 0, false
+	}
+	return uint16(pkt[2])<<8 | uint16(pkt[3]), true
+}
+
+// rtpStats is the statistics of a RTP stream, it could be read by other
+// goroutines while the stream is being received.
+type rtpStats struct {
+	received   atomic.Uint64
+	lost       atomic.Uint64
+	duplicated atomic.Uint64
+	reordered  atomic.Uint64
+}
+
+// rtpSlot is a slot in the RTP reorder buffer
+type rtpSlot struct {
+	seq   uint16
+	valid bool
+	data  []byte
+}
+
+// rtpReorderBuffer is a small jitter buffer which reorders RTP packets by
+// their sequence numbers, drops duplicates and counts the lost packets.
+type rtpReorderBuffer struct {
+	slots   []rtpSlot
+	next    uint16
+	highest uint16
+	started bool
+	stats   rtpStats
+}
+
+// newRTPReorderBuffer creates a reorder buffer which could hold at least
+// 'window' packets, the actual size is rounded up to a power of 2 so that
+// the slot index is not broken when the sequence number wraps around.
+func newRTPReorderBuffer(window int) *rtpReorderBuffer {
+	size := 1
+	for size < window {
+		size <<= 1
+	}
+	return &rtpReorderBuffer{slots: make([]rtpSlot, size)}
+}
+
+func (rb *rtpReorderBuffer) slot(seq uint16) *rtpSlot {
+	return &rb.slots[int(seq)&(len(rb.slots)-1)]
+}
+
+// emitNext emits the next packet if it is in the buffer, or counts it as
+// lost, and then moves to the next sequence number.
+func (rb *rtpReorderBuffer) emitNext(emit func([]byte)) {
+	if s := rb.slot(rb.next); s.valid && s.seq == rb.next {
+		s.valid = false
+		emit(s.data)
+	} else {
+		rb.stats.lost.Add(1)
+	}
+	rb.next++
+}
+
+// flush emits all packets in the buffer and restarts from 'seq'
+func (rb *rtpReorderBuffer) flush(seq uint16, emit func([]byte)) {
+	for range len(rb.slots) {
+		if s := rb.slot(rb.next); s.valid && s.seq == rb.next {
+			s.valid = false
+			emit(s.data)
+		}
+		rb.next++
+	}
+	rb.next = seq
+	rb.highest = seq
+}
+
+// push adds a packet to the buffer, and calls 'emit' for every packet which
+// is now in order, the data passed to 'emit' is only valid in the call.
+func (rb *rtpReorderBuffer) push(seq uint16, payload []byte, emit func([]byte)) {
+	rb.stats.received.Add(1)
+
+	if !rb.started {
+		rb.started = true
+		rb.next = seq
+		rb.highest = seq
+	}
+
+	diff := int(int16(seq - rb.next))
+	if diff >= rtpMaxDropout || diff < -rtpMaxMisorder {
+		slog.Debug(
+			"RTP sequence number jumped, resynchronizing",
+			slog.Int("expected", int(rb.next)),
+			slog.Int("received", int(seq)),
+		)
+		rb.flush(seq, emit)
+		diff = 0
+	}
+
+	// the packet is a duplicate of an emitted packet, or it arrives too late
+	// and has already been counted as lost, drop it in both cases
+	if diff < 0 {
+		rb.stats.duplicated.Add(1)
+		return
+	}
+
+	// the packet is too far ahead, skip the missing packets to make room
+	for int(seq-rb.next) >= len(rb.slots) {
+		rb.emitNext(emit)
+	}
+
+	s := rb.slot(seq)
+	if s.valid && s.seq == seq {
+		rb.stats.duplicated.Add(1)
+		return
+	}
+
+	if int16(seq-rb.highest) < 0 {
+		rb.stats.reordered.Add(1)
+	} else {
+		rb.highest = seq
+	}
+
+	s.seq = seq
+	s.valid = true
+	s.data = append(s.data[:0], payload...)
+
+	for s := rb.slot(rb.next); s.valid && s.seq == rb.next; s = rb.slot(rb.next) {
+		s.valid = false
+		emit(s.data)
+		rb.next++
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rtspMaxRedirects is the max number of redirects followed by the RTSP
+	// client
+	rtspMaxRedirects = 5
+
+	// rtspDefaultSessionTimeout is the session timeout if the server does
+	// not specify one
+	rtspDefaultSessionTimeout = 60 * time.Second
+)
+
+// rtspResponse is a response from a RTSP server
+type rtspResponse struct {
+	status int
+	reason string
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// rtspClient is a minimal RTSP client, which plays the first media stream of
+// a RTSP URL, the stream is expected to be MPEG-TS over RTP, and could be
+// transported over UDP or interleaved in the RTSP connection.
+type rtspClient struct {
+	url     *url.URL // without user info
+	user    *url.Userinfo
+	timeout time.Duration
+	conn    net.Conn
+	reader  *bufio.Reader
+
+	// lock serializes requests, as keepalive requests are sent from another
+	// goroutine
+	lock      sync.Mutex
+	cseq      int
+	session   string
+	challenge string // WWW-Authenticate header of the latest 401 response
+
+	public     string // methods supported by the server
+	sessionURL string
+	keepalive  time.Duration
+	rtpChannel byte         // for interleaved transport
+	udp        *net.UDPConn // for UDP transport
+}
+
+// newRTSPClient creates a RTSP client, 'timeout' is used for connecting to
+// the server, waiting for responses and waiting for data.
+func newRTSPClient(addr string, timeout time.Duration) (*rtspClient, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &rtspClient{timeout: timeout}
+	c.setURL(u)
+	return c, nil
+}
+
+// setURL sets the URL of the client, the user info is removed from the URL
+// as it is sent in the Authorization header
+func (c *rtspClient) setURL(u *url.URL) {
+	u = &url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host, Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	if u.User != nil {
+		c.user = u.User
+		u.User = nil
+	}
+	c.url = u
+}
+
+// dial connects to the server of the URL
+func (c *rtspClient) dial() error {
+	host := c.url.Host
+	if c.url.Port() == "" {
+		host = net.JoinHostPort(c.url.Hostname(), "554")
+	}
+	conn, err := net.DialTimeout("tcp", host, c.timeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReaderSize(conn, 65536)
+	c.cseq = 0
+	c.session = ""
+	c.challenge = ""
+	return nil
+}
+
+// authorization returns the Authorization header of a request, it supports
+// the basic and digest (without qop) authentication.
+func (c *rtspClient) authorization(method, uri string) string {
+	if c.user == nil || c.challenge == "" {
+		return ""
+	}
+
+	user := c.user.Username()
+	pass, _ := c.user.Password()
+
+	scheme, params, _ := strings.Cut(c.challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+
+	case "digest":
+		p := map[string]string{}
+		for _, kv := range strings.Split(params, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+			p[strings.ToLower(k)] = strings.Trim(v, `"`)
+		}
+		md5hex := func(s string) string {
+			sum := md5.Sum([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}
+		ha1 := md5hex(user + ":" + p["realm"] + ":" + pass)
+		ha2 := md5hex(method + ":" + uri)
+		auth := fmt.Sprintf(
+			`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+			user, p["realm"], p["nonce"], uri, md5hex(ha1+":"+p["nonce"]+":"+ha2),
+		)
+		if opaque, ok := p["opaque"]; ok {
+			auth += fmt.Sprintf(`, opaque="%s"`, opaque)
+		}
+		return auth
+	}
+
+	return ""
+}
+
+// send sends a request to the server
+func (c *rtspClient) send(method, uri string, header map[string]string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cseq++
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: MyIPTV\r\n", method, uri, c.cseq)
+	if c.session != "" {
+		fmt.Fprintf(&sb, "Session: %s\r\n", c.session)
+	}
+	if auth := c.authorization(method, uri); auth != "" {
+		fmt.Fprintf(&sb, "Authorization: %s\r\n", auth)
+	}
+	for k, v := range header {
+		fmt.Fprintf(&sb, "%s: %s\r\n", k, v)
+	}
+	sb.WriteString("\r\n")
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := io.WriteString(c.conn, sb.String())
+	return err
+}
+
+// readResponse reads a response from the server, the caller should set the
+// read deadline of the connection
+func (c *rtspClient) readResponse() (*rtspResponse, error) {
+	tp := textproto.NewReader(c.reader)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	proto, rest, _ := strings.Cut(line, " ")
+	if !strings.HasPrefix(proto, "RTSP/") {
+		return nil, fmt.Errorf("invalid RTSP response: %q", line)
+	}
+	code, reason, _ := strings.Cut(rest, " ")
+	status, err := strconv.Atoi(code)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RTSP response: %q", line)
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &rtspResponse{status: status, reason: reason, header: header}
+	if cl := header.Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return nil, errors.New("invalid content length")
+		}
+		resp.body = make([]byte, n)
+		if _, err = io.ReadFull(c.reader, resp.body); err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+// request sends a request and waits for its response, the request is resent
+// with authorization if the server requires. An error is returned if the
+// response is not successful, the response is also returned in this case.
+func (c *rtspClient) request(method, uri string, header map[string]string) (*rtspResponse, error) {
+	for retry := true; ; retry = false {
+		if err := c.send(method, uri, header); err != nil {
+			return nil, err
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.status == 401 && retry && c.user != nil {
+			// prefer the digest authentication
+			for _, v := range resp.header.Values("WWW-Authenticate") {
+				if c.challenge == "" || strings.HasPrefix(strings.ToLower(v), "digest") {
+					c.challenge = v
+				}
+			}
+			continue
+		}
+
+		if resp.status/100 != 2 {
+			return resp, fmt.Errorf("%s: %d %s", method, resp.status, resp.reason)
+		}
+		return resp, nil
+	}
+}
+
+// resolveControl resolves the control attribute of the SDP against the base
+// URL
+func resolveControl(base, control string) string {
+	if control == "" || control == "*" {
+		return base
+	}
+	if strings.HasPrefix(strings.ToLower(control), "rtsp://") {
+		return control
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + control
+	u.RawPath = ""
+	return u.String()
+}
+
+// parseSDP returns the session URL and the URL of the first media stream
+// from the SDP
+func parseSDP(sdp, base string) (string, string) {
+	var session, media string
+	inMedia := false
+
+LOOP:
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			if inMedia {
+				// only the first media stream is played
+				break LOOP
+			}
+			inMedia = true
+		case strings.HasPrefix(line, "a=control:"):
+			if inMedia {
+				media = line[len("a=control:"):]
+			} else {
+				session = line[len("a=control:"):]
+			}
+		}
+	}
+
+	sessionURL := resolveControl(base, session)
+	return sessionURL, resolveControl(sessionURL, media)
+}
+
+// describe connects to the server and describes the URL, it follows the
+// redirects. It returns the URL of the media stream.
+func (c *rtspClient) describe() (string, error) {
+	for i := 0; ; i++ {
+		if err := c.dial(); err != nil {
+			return "", err
+		}
+
+		// some servers do not support OPTIONS, so its error is ignored
+		if resp, err := c.request("OPTIONS", c.url.String(), nil); err == nil {
+			c.public = resp.header.Get("Public")
+		}
+
+		header := map[string]string{"Accept": "application/sdp"}
+		resp, err := c.request("DESCRIBE", c.url.String(), header)
+		if err == nil {
+			base := resp.header.Get("Content-Base")
+			if base == "" {
+				base = resp.header.Get("Content-Location")
+			}
+			if base == "" {
+				base = c.url.String()
+			}
+			sessionURL, mediaURL := parseSDP(string(resp.body), base)
+			c.sessionURL = sessionURL
+			return mediaURL, nil
+		}
+
+		c.conn.Close()
+		if resp == nil || resp.status/100 != 3 || i >= rtspMaxRedirects {
+			return "", err
+		}
+
+		loc, perr := c.url.Parse(resp.header.Get("Location"))
+		if perr != nil || loc.Host == "" {
+			return "", err
+		}
+		c.setURL(loc)
+	}
+}
+
+// setup sets up the media stream with the transport, 'tcp' specifies whether
+// the stream is interleaved in the RTSP connection or transported over UDP.
+func (c *rtspClient) setup(mediaURL string, tcp bool) error {
+	transport := "RTP/AVP/TCP;unicast;interleaved=0-1"
+	if !tcp {
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return err
+		}
+		c.udp = udp
+		port := udp.LocalAddr().(*net.UDPAddr).Port
+		transport = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", port, port+1)
+	}
+
+	resp, err := c.request("SETUP", mediaURL, map[string]string{"Transport": transport})
+	if err != nil {
+		return err
+	}
+
+	id, params, _ := strings.Cut(resp.header.Get("Session"), ";")
+	c.session = strings.TrimSpace(id)
+	c.keepalive = rtspDefaultSessionTimeout / 2
+	if v, ok := strings.CutPrefix(strings.TrimSpace(params), "timeout="); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.keepalive = time.Duration(n) * time.Second / 2
+		}
+	}
+
+	for _, p := range strings.Split(resp.header.Get("Transport"), ";") {
+		if v, ok := strings.CutPrefix(p, "interleaved="); ok {
+			first, _, _ := strings.Cut(v, "-")
+			if n, err := strconv.Atoi(first); err == nil {
+				c.rtpChannel = byte(n)
+			}
+		}
+	}
+
+	return nil
+}
+
+// open describes, sets up and plays the URL
+func (c *rtspClient) open(tcp bool) error {
+	mediaURL, err := c.describe()
+	if err != nil {
+		return err
+	}
+
+	err = c.setup(mediaURL, tcp)
+	if err == nil {
+		_, err = c.request("PLAY", c.sessionURL, map[string]string{"Range": "npt=0.000-"})
+	}
+	if err != nil {
+		c.closeConns()
+	}
+	return err
+}
+
+// keepAlive sends keepalive requests periodically until 'ctx' is done, the
+// responses are handled by the reading goroutine.
+func (c *rtspClient) keepAlive(ctx context.Context) {
+	method := "OPTIONS"
+	if strings.Contains(c.public, "GET_PARAMETER") {
+		method = "GET_PARAMETER"
+	}
+
+	ticker := time.NewTicker(c.keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if c.send(method, c.sessionURL, nil) != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readInterleaved reads the interleaved RTP packets from the RTSP connection
+// and passes them to 'handle' until it returns false or an error occurs
+func (c *rtspClient) readInterleaved(handle func([]byte) bool) error {
+	var hdr [4]byte
+	buf := make([]byte, 65536)
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return err
+		}
+
+		if b[0] != '$' {
+			// a response of the keepalive request, or garbage
+			if b[0] == 'R' {
+				if _, err = c.readResponse(); err != nil {
+					return err
+				}
+			} else {
+				c.reader.Discard(1)
+			}
+			continue
+		}
+
+		if _, err = io.ReadFull(c.reader, hdr[:]); err != nil {
+			return err
+		}
+		data := buf[:binary.BigEndian.Uint16(hdr[2:])]
+		if _, err = io.ReadFull(c.reader, data); err != nil {
+			return err
+		}
+		if hdr[1] == c.rtpChannel && len(data) > 0 && !handle(data) {
+			return nil
+		}
+	}
+}
+
+// readUDP reads the RTP packets from the UDP connection and passes them to
+// 'handle' until it returns false or an error occurs
+func (c *rtspClient) readUDP(handle func([]byte) bool) error {
+	// drain the responses of the keepalive requests
+	go func() {
+		c.conn.SetReadDeadline(time.Time{})
+		for {
+			if _, err := c.readResponse(); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		c.udp.SetReadDeadline(time.Now().Add(c.timeout))
+		n, err := c.udp.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n > 0 && !handle(buf[:n]) {
+			return nil
+		}
+	}
+}
+
+// closeConns closes the connections without tearing down the session, it is
+// used to interrupt the reading
+func (c *rtspClient) closeConns() {
+	c.conn.Close()
+	if c.udp != nil {
+		c.udp.Close()
+	}
+}
+
+// close tears down the session and closes the connections
+func (c *rtspClient) close() {
+	c.send("TEARDOWN", c.sessionURL, nil)
+	c.closeConns()
+}
+
+// pullRTSP plays the RTSP upstream and relays the RTP payload to clients
+// until the stream fails or stalls, or all clients are gone. Its return
+// values are the same as 'pullHTTP'.
+func (mc *mcastConn) pullRTSP() (int64, bool, error) {
+	cfg := getConfig()
+	c, err := newRTSPClient(mc.addr, time.Duration(cfg.SourceTimeout)*time.Millisecond)
+	if err != nil {
+		return 0, true, err
+	}
+	if err = c.open(cfg.RTSPTransport != "udp"); err != nil {
+		return 0, true, err
+	}
+	defer c.close()
+
+	ctx, cancel := context.WithCancel(mc.ctx)
+	defer cancel()
+	go c.keepAlive(ctx)
+
+	// interrupt the reading if the relay connection is closed
+	stop := context.AfterFunc(mc.ctx, c.closeConns)
+	defer stop()
+
+	received, alive := int64(0), true
+	handle := func(pkt []byte) bool {
+		received += int64(len(pkt))
+		alive = mc.writePacket(pkt)
+		return alive
+	}
+
+	if c.udp != nil {
+		err = c.readUDP(handle)
+	} else {
+		err = c.readInterleaved(handle)
+	}
+	return received, alive, err
+}
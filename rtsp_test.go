@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testRTSPUser  = "user"
+	testRTSPPass  = "secret"
+	testRTSPRealm = "myiptv"
+	testRTSPNonce = "0123456789abcdef"
+)
+
+// testTSPacket is the MPEG-TS packet carried by the test RTSP server
+var testTSPacket = func() []byte {
+	pkt := bytes.Repeat([]byte{0xAB}, tsPacketSize)
+	copy(pkt, []byte{tsSyncByte, 0x01, 0x00, 0x10})
+	return pkt
+}()
+
+// testRTSPServer is a minimal RTSP server, it requires digest authentication
+// and streams MPEG-TS over RTP after PLAY, the RTP packets are interleaved
+// or sent to the UDP port of the client according to the SETUP request.
+type testRTSPServer struct {
+	t        *testing.T
+	ln       net.Listener
+	requests chan string // methods of the authorized requests
+}
+
+func newTestRTSPServer(t *testing.T) *testRTSPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testRTSPServer{t: t, ln: ln, requests: make(chan string, 100)}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *testRTSPServer) url() string {
+	return fmt.Sprintf("rtsp://%s:%s@%s/live", testRTSPUser, testRTSPPass, s.ln.Addr())
+}
+
+func (s *testRTSPServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// authorized checks the Authorization header of a request
+func (s *testRTSPServer) authorized(method, uri string, header textproto.MIMEHeader) bool {
+	md5hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := md5hex(testRTSPUser + ":" + testRTSPRealm + ":" + testRTSPPass)
+	ha2 := md5hex(method + ":" + uri)
+	expected := fmt.Sprintf(`response="%s"`, md5hex(ha1+":"+testRTSPNonce+":"+ha2))
+	return strings.Contains(header.Get("Authorization"), expected)
+}
+
+func (s *testRTSPServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		lock     sync.Mutex // serializes writes to the connection
+		udp      net.Conn
+		playing  bool
+		teardown = make(chan struct{})
+	)
+	defer close(teardown)
+
+	reply := func(cseq, status, body string, header ...string) {
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Fprintf(conn, "RTSP/1.0 %s\r\nCSeq: %s\r\n", status, cseq)
+		for _, h := range header {
+			fmt.Fprintf(conn, "%s\r\n", h)
+		}
+		if body != "" {
+			fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+		}
+		fmt.Fprint(conn, "\r\n", body)
+	}
+
+	// stream sends RTP packets, each carries 7 TS packets, until TEARDOWN
+	stream := func() {
+		payload := bytes.Repeat(testTSPacket, 7)
+		for seq := uint16(0); ; seq++ {
+			pkt := make([]byte, 12, 12+len(payload))
+			pkt[0] = 0x80
+			pkt[1] = 33
+			binary.BigEndian.PutUint16(pkt[2:], seq)
+			pkt = append(pkt, payload...)
+
+			var err error
+			if udp != nil {
+				_, err = udp.Write(pkt)
+			} else {
+				lock.Lock()
+				_, err = conn.Write(append([]byte{'$', 0, byte(len(pkt) >> 8), byte(len(pkt))}, pkt...))
+				lock.Unlock()
+			}
+			if err != nil {
+				return
+			}
+
+			select {
+			case <-teardown:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			s.t.Errorf("invalid request line: %q", line)
+			return
+		}
+		method, uri, cseq := fields[0], fields[1], header.Get("CSeq")
+
+		if !s.authorized(method, uri, header) {
+			reply(cseq, "401 Unauthorized", "",
+				`WWW-Authenticate: Basic realm="`+testRTSPRealm+`"`,
+				`WWW-Authenticate: Digest realm="`+testRTSPRealm+`", nonce="`+testRTSPNonce+`"`,
+			)
+			continue
+		}
+		s.requests <- method
+
+		switch method {
+		case "OPTIONS", "GET_PARAMETER":
+			reply(cseq, "200 OK", "", "Public: OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER")
+
+		case "DESCRIBE":
+			sdp := "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=test\r\na=control:*\r\n" +
+				"m=video 0 RTP/AVP 33\r\na=control:trackID=1\r\n"
+			reply(cseq, "200 OK", sdp, "Content-Type: application/sdp", "Content-Base: "+uri+"/")
+
+		case "SETUP":
+			if !strings.HasSuffix(uri, "/live/trackID=1") {
+				s.t.Errorf("unexpected SETUP URL: %s", uri)
+			}
+			transport := header.Get("Transport")
+			if _, ports, ok := strings.Cut(transport, "client_port="); ok {
+				port, _, _ := strings.Cut(ports, "-")
+				host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+				if udp, err = net.Dial("udp", net.JoinHostPort(host, port)); err != nil {
+					s.t.Error(err)
+					return
+				}
+				defer udp.Close()
+			} else {
+				transport = "RTP/AVP/TCP;unicast;interleaved=0-1"
+			}
+			// the client sends keepalive requests every half of the timeout
+			reply(cseq, "200 OK", "", "Session: 12345678;timeout=1", "Transport: "+transport)
+
+		case "PLAY":
+			reply(cseq, "200 OK", "", "Session: 12345678")
+			if !playing {
+				playing = true
+				go stream()
+			}
+
+		case "TEARDOWN":
+			reply(cseq, "200 OK", "")
+			return
+
+		default:
+			reply(cseq, "501 Not Implemented", "")
+		}
+	}
+}
+
+// waitRequest waits for an authorized request of the method
+func (s *testRTSPServer) waitRequest(method string, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m := <-s.requests:
+			if m == method {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func testPullRTSP(t *testing.T, transport string) {
+	cfg := &Config{
+		ServerAddr:    "127.0.0.1:7709",
+		McastIface:    "lo",
+		RTSPTransport: transport,
+		RelayLinger:   -1,
+	}
+	cfg.populateDefault()
+	cfg.WriteBufferSize = tsPacketSize * 7
+	old := config.Load()
+	config.Store(cfg)
+	t.Cleanup(func() {
+		if old != nil {
+			config.Store(old)
+		}
+	})
+
+	s := newTestRTSPServer(t)
+	mc, created, err := mcastJoin(s.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("connection is not newly created")
+	}
+	rc := mc.attachClient("test", created)
+
+	for _, method := range []string{"DESCRIBE", "SETUP", "PLAY"} {
+		if !s.waitRequest(method, 5*time.Second) {
+			t.Fatalf("%s is not received", method)
+		}
+	}
+
+	// the payload of the RTP packets reaches the ring buffer by 'write'
+	select {
+	case <-rc.ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no data is received")
+	}
+	data := rc.read()
+	if len(data) == 0 || len(data)%tsPacketSize != 0 {
+		t.Fatalf("invalid data size: %d", len(data))
+	}
+	for i := 0; i < len(data); i += tsPacketSize {
+		if !bytes.Equal(data[i:i+tsPacketSize], testTSPacket) {
+			t.Fatalf("unexpected TS packet at %d", i)
+		}
+	}
+	if mc.received.Load() == 0 {
+		t.Fatal("received bytes are not counted")
+	}
+
+	if !s.waitRequest("GET_PARAMETER", 5*time.Second) {
+		t.Fatal("keepalive request is not received")
+	}
+
+	// the session is torn down after the last client leaves
+	mc.detachClient(rc)
+	if !s.waitRequest("TEARDOWN", 5*time.Second) {
+		t.Fatal("TEARDOWN is not received")
+	}
+
+	select {
+	case <-mc.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+}
+
+func TestPullRTSPInterleaved(t *testing.T) {
+	testPullRTSP(t, "tcp")
+}
+
+func TestPullRTSPUDP(t *testing.T) {
+	testPullRTSP(t, "udp")
+}
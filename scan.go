@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scanMaxSockets is the max number of sockets opened at the same time in a
+// scan, to avoid running out of file descriptors
+const scanMaxSockets = 256
+
+// scanMinPrefixBits is the min prefix length of a scan range, that's, a
+// range contains at most 65536 multicast groups
+const scanMinPrefixBits = 16
+
+// scanRange is a range of multicast addresses to scan, for example:
+// '225.1.8.0/24:8000-8200'
+type scanRange struct {
+	prefix netip.Prefix
+	first  uint16
+	last   uint16
+}
+
+// parseScanRange parses a scan range, the prefix could also be a single IP
+// address, and the port range could also be a single port.
+func parseScanRange(s string) (scanRange, error) {
+	var sr scanRange
+
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return sr, errors.New("missing port range")
+	}
+
+	prefix, ports := s[:i], s[i+1:]
+	if strings.Contains(prefix, "/") {
+		p, err := netip.ParsePrefix(prefix)
+		if err != nil {
+			return sr, err
+		}
+		sr.prefix = p.Masked()
+	} else {
+		addr, err := netip.ParseAddr(prefix)
+		if err != nil {
+			return sr, err
+		}
+		sr.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if !sr.prefix.Addr().Is4() || !sr.prefix.Addr().IsMulticast() {
+		return sr, errors.New("not an IPv4 multicast address range")
+	}
+	if sr.prefix.Bits() < scanMinPrefixBits {
+		return sr, fmt.Errorf("address range too large, the prefix length must be at least %d", scanMinPrefixBits)
+	}
+
+	first, last, found := strings.Cut(ports, "-")
+	if !found {
+		last = first
+	}
+	lo, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return sr, err
+	}
+	hi, err := strconv.ParseUint(last, 10, 16)
+	if err != nil {
+		return sr, err
+	}
+	if lo == 0 || lo > hi {
+		return sr, errors.New("invalid port range")
+	}
+	sr.first, sr.last = uint16(lo), uint16(hi)
+
+	return sr, nil
+}
+
+// groups returns the number of multicast groups in the range
+func (sr scanRange) groups() int {
+	return 1 << (sr.prefix.Addr().BitLen() - sr.prefix.Bits())
+}
+
+// ports returns all ports in the range
+func (sr scanRange) ports() []uint16 {
+	result := make([]uint16, 0, int(sr.last)-int(sr.first)+1)
+	for port := int(sr.first); port <= int(sr.last); port++ {
+		result = append(result, uint16(port))
+	}
+	return result
+}
+
+// scanResult is a live multicast source found by a scan
+type scanResult struct {
+	Addr         string `json:"addr"`
+	RTP          bool   `json:"rtp"`
+	ServiceName  string `json:"serviceName,omitempty"`
+	ProviderName string `json:"providerName,omitempty"`
+}
+
+// scanner scans multicast address ranges for live IPTV sources
+type scanner struct {
+	ranges    []scanRange
+	timeout   time.Duration
+	startedAt time.Time
+	total     int
+	done      atomic.Int64
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	lock    sync.Mutex
+	running bool
+	results []scanResult
+}
+
+// newScanner creates a scanner, 'timeout' is the time to wait for data from
+// each multicast group.
+func newScanner(ranges []scanRange, timeout time.Duration) *scanner {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scanner{
+		ranges:  ranges,
+		timeout: timeout,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	for _, sr := range ranges {
+		s.total += sr.groups() * len(sr.ports())
+	}
+	return s
+}
+
+// probe waits for data from a connection until the deadline, it returns nil
+// if no IPTV data is received.
+func (s *scanner) probe(conn *net.UDPConn, addr string, deadline time.Time) *scanResult {
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, getConfig().McastPacketSize)
+
+	var (
+		result *scanResult
+		psi    = newTSPSIParser()
+	)
+
+	for s.ctx.Err() == nil {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+
+		p := extractPayload(buf[:n])
+		if len(p) == 0 || p[0] != tsSyncByte {
+			continue
+		}
+
+		if result == nil {
+			_, rtp := rtpSequence(buf[:n])
+			result = &scanResult{Addr: addr, RTP: rtp}
+		}
+
+		tsForEachPacket(p, psi.handlePacket)
+		if info := psi.getInfo(); info != nil {
+			for _, prog := range info.Programs {
+				if prog.ServiceName != "" {
+					result.ServiceName = prog.ServiceName
+					result.ProviderName = prog.ProviderName
+					return result
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// scanGroup scans the ports of a multicast group
+func (s *scanner) scanGroup(iface *net.Interface, group netip.Addr, ports []uint16) {
+	deadline := time.Now().Add(s.timeout)
+
+	var wg sync.WaitGroup
+	for _, port := range ports {
+		addr := netip.AddrPortFrom(group, port).String()
+		udpAddr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(group, port))
+		conn, err := listenMulticast(iface, udpAddr, netip.Addr{})
+		if err != nil {
+			slog.Debug(
+				"failed to listen to multicast address",
+				slog.String("address", addr),
+				slog.String("error", err.Error()),
+			)
+			s.done.Add(1)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := s.probe(conn, addr, deadline)
+			conn.Close()
+			s.done.Add(1)
+
+			if result == nil {
+				return
+			}
+			slog.Info(
+				"live multicast source found",
+				slog.String("address", result.Addr),
+				slog.String("serviceName", result.ServiceName),
+			)
+			s.lock.Lock()
+			s.results = append(s.results, *result)
+			s.lock.Unlock()
+		}()
+	}
+
+	wg.Wait()
+}
+
+// run scans all the ranges, it blocks until the scan completes or it is
+// canceled.
+func (s *scanner) run() error {
+	s.lock.Lock()
+	s.running = true
+	s.startedAt = time.Now()
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.running = false
+		slices.SortFunc(s.results, func(a, b scanResult) int {
+			return strings.Compare(a.Addr, b.Addr)
+		})
+		s.lock.Unlock()
+		s.cancel()
+	}()
+
+	cfg := getConfig()
+	iface, err := net.InterfaceByName(cfg.McastIface)
+	if err != nil {
+		slog.Error(
+			"failed to get network interface",
+			slog.String("interface", cfg.McastIface),
+			slog.String("error", err.Error()),
+		)
+		return err
+	}
+
+	slog.Info("multicast scan started", slog.Int("addresses", s.total))
+
+	for _, sr := range s.ranges {
+		ports := sr.ports()
+		group := sr.prefix.Addr()
+		for range sr.groups() {
+			for i := 0; i < len(ports); i += scanMaxSockets {
+				if s.ctx.Err() != nil {
+					slog.Info("multicast scan canceled")
+					return s.ctx.Err()
+				}
+				s.scanGroup(iface, group, ports[i:min(i+scanMaxSockets, len(ports))])
+			}
+			group = group.Next()
+		}
+	}
+
+	slog.Info("multicast scan finished", slog.Int("found", len(s.results)))
+	return nil
+}
+
+// writeCSV writes the results in the CSV format which could be imported by
+// the admin UI.
+func (s *scanner) writeCSV(w io.Writer, group string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fmt.Fprintln(w, "#Group,Name,DisplayName,Hide,Logo,Source")
+	for _, r := range s.results {
+		name := strings.ReplaceAll(r.ServiceName, ",", " ")
+		if name == "" {
+			name = r.Addr
+		}
+		fmt.Fprintf(w, "%s,%s,,F,,%s\n", group, name, r.Addr)
+	}
+}
+
+var (
+	// currentScan is the latest scan started by the API
+	currentScan *scanner
+	scanLock    sync.Mutex
+)
+
+// apiStartScan starts a scan in background
+func apiStartScan(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Ranges []string `json:"ranges"`
+
+		// Timeout is the time to wait for data from each multicast group,
+		// its unit is millisecond, default is 2000
+		Timeout int `json:"timeout"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Ranges) == 0 {
+		http.Error(w, "missing scan ranges", http.StatusBadRequest)
+		return
+	}
+	if req.Timeout <= 0 {
+		req.Timeout = 2000
+	}
+
+	ranges := make([]scanRange, 0, len(req.Ranges))
+	for _, s := range req.Ranges {
+		sr, err := parseScanRange(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %s", s, err), http.StatusBadRequest)
+			return
+		}
+		ranges = append(ranges, sr)
+	}
+
+	scanLock.Lock()
+	defer scanLock.Unlock()
+
+	if currentScan != nil && currentScan.ctx.Err() == nil {
+		http.Error(w, "another scan is running", http.StatusConflict)
+		return
+	}
+
+	currentScan = newScanner(ranges, time.Duration(req.Timeout)*time.Millisecond)
+	go currentScan.run()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// apiGetScan returns the progress and results of the latest scan, the results
+// are returned in CSV format if query parameter 'fmt' is 'csv', and the group
+// name in the CSV could be specified by query parameter 'group'.
+func apiGetScan(w http.ResponseWriter, r *http.Request) {
+	scanLock.Lock()
+	s := currentScan
+	scanLock.Unlock()
+
+	if s == nil {
+		http.Error(w, "no scan", http.StatusNotFound)
+		return
+	}
+
+	if strings.ToLower(r.URL.Query().Get("fmt")) == "csv" {
+		group := r.URL.Query().Get("group")
+		if group == "" {
+			group = "Scanned"
+		}
+		w.Header().Set("Content-Type", "text/csv;charset=UTF-8")
+		s.writeCSV(w, group)
+		return
+	}
+
+	s.lock.Lock()
+	result := struct {
+		Running   bool         `json:"running"`
+		StartedAt time.Time    `json:"startedAt"`
+		Total     int          `json:"total"`
+		Done      int64        `json:"done"`
+		Results   []scanResult `json:"results"`
+	}{
+		Running:   s.running,
+		StartedAt: s.startedAt,
+		Total:     s.total,
+		Done:      s.done.Load(),
+		Results:   slices.Clone(s.results),
+	}
+	s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(result)
+}
+
+// apiCancelScan cancels the running scan
+func apiCancelScan(w http.ResponseWriter, r *http.Request) {
+	scanLock.Lock()
+	defer scanLock.Unlock()
+	if currentScan != nil {
+		currentScan.cancel()
+	}
+}
+
+// cliScan is the 'scan' sub command, it scans the ranges in the arguments
+// and writes the results to stdout in CSV format, which could be imported
+// by the admin UI. It returns the exit code of the program.
+func cliScan(args []string) int {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: myiptv scan [options] <range>...")
+		fmt.Fprintln(fs.Output(), "Example: myiptv scan 225.1.8.0/24:8000-8200")
+		fs.PrintDefaults()
+	}
+	timeout := fs.Duration("timeout", 2*time.Second, "time to wait for data from each multicast group")
+	group := fs.String("group", "Scanned", "group name of the channels in the output")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	ranges := make([]scanRange, 0, fs.NArg())
+	for _, s := range fs.Args() {
+		sr, err := parseScanRange(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", s, err)
+			return 2
+		}
+		ranges = append(ranges, sr)
+	}
+
+	s := newScanner(ranges, *timeout)
+	if err := s.run(); err != nil {
+		return 1
+	}
+
+	s.writeCSV(os.Stdout, *group)
+	return 0
+}
@@ -0,0 +1,170 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+)
+
+// below options are not defined in package syscall
+const (
+	ipMulticastAll        = 49 // IP_MULTICAST_ALL
+	ipv6MulticastAll      = 29 // IPV6_MULTICAST_ALL
+	mcastJoinSourceGroup  = 46 // MCAST_JOIN_SOURCE_GROUP
+	sizeofSockaddrStorage = 128
+)
+
+// putSockaddr writes 'addr' to 'buf' as a sockaddr_in or sockaddr_in6
+func putSockaddr(buf []byte, addr netip.Addr) {
+	if addr.Is4() {
+		binary.NativeEndian.PutUint16(buf, syscall.AF_INET)
+		a := addr.As4()
+		copy(buf[4:], a[:])
+	} else {
+		binary.NativeEndian.PutUint16(buf, syscall.AF_INET6)
+		a := addr.As16()
+		copy(buf[8:], a[:])
+	}
+}
+
+// joinSourceGroup joins the source-specific multicast group on the interface
+func joinSourceGroup(conn *net.UDPConn, iface *net.Interface, group, source netip.Addr) error {
+	// struct group_source_req {
+	//     uint32_t                gsr_interface;
+	//     struct sockaddr_storage gsr_group;
+	//     struct sockaddr_storage gsr_source;
+	// };
+	// sockaddr_storage is aligned to the size of long
+	off := max(4, strconv.IntSize/8)
+	req := make([]byte, off+2*sizeofSockaddrStorage)
+	if iface != nil {
+		binary.NativeEndian.PutUint32(req, uint32(iface.Index))
+	}
+	putSockaddr(req[off:], group)
+	putSockaddr(req[off+sizeofSockaddrStorage:], source)
+
+	level := syscall.IPPROTO_IP
+	if !group.Is4() {
+		level = syscall.IPPROTO_IPV6
+	}
+	return setsockopt(conn, func(fd int) error {
+		return syscall.SetsockoptString(fd, level, mcastJoinSourceGroup, string(req))
+	})
+}
+
+// setsockopt calls 'fn' with the file descriptor of the connection
+func setsockopt(conn *net.UDPConn, fn func(fd int) error) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err = rc.Control(func(fd uintptr) { serr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return serr
+}
+
+// isIPv6Conn reports whether the connection is an IPv6 socket
+func isIPv6Conn(conn *net.UDPConn) bool {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() == nil && len(addr.IP) == net.IPv6len
+}
+
+// setMulticastInterface sets the outgoing interface of the multicast packets
+// sent by the connection
+func setMulticastInterface(conn *net.UDPConn, iface *net.Interface) error {
+	ipv6 := isIPv6Conn(conn)
+	return setsockopt(conn, func(fd int) error {
+		if ipv6 {
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index)
+		}
+		mreq := &syscall.IPMreqn{Ifindex: int32(iface.Index)}
+		return syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, mreq)
+	})
+}
+
+// setMulticastTTL sets the TTL (hop limit for IPv6) of the multicast packets
+// sent by the connection
+func setMulticastTTL(conn *net.UDPConn, ttl int) error {
+	ipv6 := isIPv6Conn(conn)
+	return setsockopt(conn, func(fd int) error {
+		if ipv6 {
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl)
+		}
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+	})
+}
+
+// listenMulticast joins the multicast group on the interface, the join is
+// source-specific if 'source' is valid. Unlike net.ListenMulticastUDP, the
+// returned connection only receives datagrams sent to the group, even if
+// other groups on the same port are joined by other sockets.
+func listenMulticast(iface *net.Interface, gaddr *net.UDPAddr, source netip.Addr) (*net.UDPConn, error) {
+	// the socket is bound to the group address and port, and IP_MULTICAST_ALL
+	// (IPV6_MULTICAST_ALL for IPv6) is cleared, so that it does not also
+	// receive the datagrams of other groups joined on the same port by other
+	// sockets
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if network == "udp6" {
+					serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6MulticastAll, 0)
+				} else {
+					serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipMulticastAll, 0)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+
+	network := "udp4"
+	if gaddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	pc, err := lc.ListenPacket(context.Background(), network, gaddr.String())
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+
+	if source.IsValid() {
+		group, _ := netip.AddrFromSlice(gaddr.IP)
+		if err = joinSourceGroup(conn, iface, group.Unmap(), source); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	ifindex := 0
+	if iface != nil {
+		ifindex = iface.Index
+	}
+
+	err = setsockopt(conn, func(fd int) error {
+		if network == "udp6" {
+			mreq := &syscall.IPv6Mreq{Interface: uint32(ifindex)}
+			copy(mreq.Multiaddr[:], gaddr.IP.To16())
+			return syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+		}
+		mreq := &syscall.IPMreqn{Ifindex: int32(ifindex)}
+		copy(mreq.Multiaddr[:], gaddr.IP.To4())
+		return syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
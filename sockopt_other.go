@@ -0,0 +1,31 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// setMulticastInterface sets the outgoing interface of the multicast packets
+// sent by the connection
+func setMulticastInterface(conn *net.UDPConn, iface *net.Interface) error {
+	return errors.ErrUnsupported
+}
+
+// setMulticastTTL sets the TTL of the multicast packets sent by the connection
+func setMulticastTTL(conn *net.UDPConn, ttl int) error {
+	return errors.ErrUnsupported
+}
+
+// listenMulticast joins the multicast group on the interface, other systems
+// filter the received datagrams by the groups joined by each socket, so
+// net.ListenMulticastUDP is good enough. Source-specific multicast is not
+// supported on these systems.
+func listenMulticast(iface *net.Interface, gaddr *net.UDPAddr, source netip.Addr) (*net.UDPConn, error) {
+	if source.IsValid() {
+		return nil, errors.ErrUnsupported
+	}
+	return net.ListenMulticastUDP("udp", iface, gaddr)
+}
@@ -0,0 +1,38 @@
+package main
+
+// policies for stalled clients, see 'Config.StallPolicy'
+const (
+	stallPolicyDrop       = "drop"
+	stallPolicyDisconnect = "disconnect"
+	stallPolicyDowngrade  = "downgrade"
+)
+
+// tsKeyframeFilter removes the video packets which are not part of a key
+// frame from a transport stream, it is used to reduce the bitrate of a
+// downgraded client. Video PIDs are recognized by the stream ID in the PES
+// headers, so the filter does not depend on the PMT.
+type tsKeyframeFilter struct {
+	// video maps a video PID to whether its current PES is a key frame
+	video map[uint16]bool
+}
+
+func newTSKeyframeFilter() *tsKeyframeFilter {
+	return &tsKeyframeFilter{video: map[uint16]bool{}}
+}
+
+// filter removes the packets in place and returns the remaining data
+func (f *tsKeyframeFilter) filter(buf []byte) []byte {
+	out := buf[:0]
+	tsForEachPacket(buf, func(pkt []byte) {
+		pid := tsPID(pkt)
+		if tsPayloadUnitStart(pkt) {
+			if p := tsPayload(pkt); len(p) >= 4 && p[0] == 0 && p[1] == 0 && p[2] == 1 && p[3]&0xF0 == 0xE0 {
+				f.video[pid] = tsRandomAccess(pkt)
+			}
+		}
+		if keep, ok := f.video[pid]; !ok || keep {
+			out = append(out, pkt...)
+		}
+	})
+	return out
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeshiftSegmentDuration is the duration of a timeshift segment file
+const timeshiftSegmentDuration = time.Minute
+
+// timeshiftSegment is a file of a timeshift buffer
+type timeshiftSegment struct {
+	path  string
+	start time.Time
+	size  int64
+}
+
+// timeshiftPoint is a position in a timeshift buffer where playback could
+// start from, it is generally the start of a key frame
+type timeshiftPoint struct {
+	time   time.Time
+	seg    *timeshiftSegment
+	offset int64
+}
+
+// timeshiftBuffer is a rolling on-disk buffer of a multicast address, it is
+// a persistent client of the multicast connection. Use a directory in tmpfs
+// (e.g. /dev/shm/myiptv) as the timeshift directory to keep the buffer in
+// memory.
+type timeshiftBuffer struct {
+	addr     string
+	dir      string
+	duration time.Duration
+
+	lock     sync.Mutex
+	segments []*timeshiftSegment
+	points   []timeshiftPoint
+	psi      []byte // latest PAT and PMTs, sent to readers first
+
+	// notify is closed and recreated when new data is written
+	notify chan struct{}
+
+	// below fields are only accessed by the 'run' goroutine
+	file    *os.File
+	parser  *tsPSIParser
+	pat     []byte
+	pmts    map[uint16][]byte
+	lastKey time.Time
+}
+
+var timeshiftBuffers = map[string]*timeshiftBuffer{}
+
+// getTimeshiftBuffer returns the timeshift buffer of the address, or nil if
+// timeshift is not enabled for the address. The map is only modified at
+// startup, so no lock is required.
+func getTimeshiftBuffer(addr string) *timeshiftBuffer {
+	return timeshiftBuffers[addr]
+}
+
+// wait returns a channel which is closed when new data is written
+func (tb *timeshiftBuffer) wait() <-chan struct{} {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	return tb.notify
+}
+
+// rotate closes the current segment file and creates a new one, it also
+// removes segments older than the duration of the buffer.
+func (tb *timeshiftBuffer) rotate(now time.Time) error {
+	if tb.file != nil {
+		tb.file.Close()
+		tb.file = nil
+	}
+
+	path := filepath.Join(tb.dir, fmt.Sprintf("%d.ts", now.UnixMilli()))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	tb.file = f
+
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.segments = append(tb.segments, &timeshiftSegment{path: path, start: now})
+
+	// a segment could be removed if the next segment starts before the
+	// beginning of the buffer
+	oldest := now.Add(-tb.duration)
+	for len(tb.segments) > 1 && tb.segments[1].start.Before(oldest) {
+		os.Remove(tb.segments[0].path)
+		tb.segments = tb.segments[1:]
+	}
+	i := 0
+	for i < len(tb.points) && tb.points[i].seg.start.Before(tb.segments[0].start) {
+		i++
+	}
+	tb.points = tb.points[i:]
+
+	return nil
+}
+
+// updatePSI tracks PAT and PMTs, and returns the offset of the first key frame
+// in the data, or -1 if there's no key frame.
+func (tb *timeshiftBuffer) updatePSI(data []byte) int {
+	pos, keyPos := 0, -1
+	changed := false
+
+	tsForEachPacket(data, func(pkt []byte) {
+		tb.parser.handlePacket(pkt)
+		pid := tsPID(pkt)
+		if pid == tsPIDPAT && tsPayloadUnitStart(pkt) {
+			changed = changed || string(tb.pat) != string(pkt)
+			tb.pat = append(tb.pat[:0], pkt...)
+		} else if tb.parser.isPMTPID(pid) && tsPayloadUnitStart(pkt) {
+			changed = changed || string(tb.pmts[pid]) != string(pkt)
+			tb.pmts[pid] = append(tb.pmts[pid][:0], pkt...)
+		}
+
+		if keyPos < 0 && tsRandomAccess(pkt) && tb.parser.isVideoPID(pid) {
+			keyPos = pos
+		}
+		pos += tsPacketSize
+	})
+
+	if changed {
+		psi := append([]byte{}, tb.pat...)
+		for _, pmt := range tb.pmts {
+			psi = append(psi, pmt...)
+		}
+		tb.lock.Lock()
+		tb.psi = psi
+		tb.lock.Unlock()
+	}
+
+	return keyPos
+}
+
+// write writes data to the current segment, and adds a playback point if
+// the data contains a key frame, or there's no key frame for a long time.
+func (tb *timeshiftBuffer) write(data []byte, now time.Time) error {
+	tb.lock.Lock()
+	seg := tb.segments[len(tb.segments)-1]
+	tb.lock.Unlock()
+
+	if now.Sub(seg.start) >= timeshiftSegmentDuration {
+		if err := tb.rotate(now); err != nil {
+			return err
+		}
+		tb.lock.Lock()
+		seg = tb.segments[len(tb.segments)-1]
+		tb.lock.Unlock()
+	}
+
+	keyPos := tb.updatePSI(data)
+	if _, err := tb.file.Write(data); err != nil {
+		return err
+	}
+
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	if keyPos >= 0 {
+		tb.lastKey = now
+		tb.points = append(tb.points, timeshiftPoint{now, seg, seg.size + int64(keyPos)})
+	} else if now.Sub(tb.lastKey) > time.Second {
+		// the stream may not set the random access indicator
+		tb.lastKey = now
+		tb.points = append(tb.points, timeshiftPoint{now, seg, seg.size})
+	}
+	seg.size += int64(len(data))
+
+	close(tb.notify)
+	tb.notify = make(chan struct{})
+	return nil
+}
+
+// receive receives data from the multicast connection until it is closed
+func (tb *timeshiftBuffer) receive() error {
+	mc, created, err := mcastJoin(tb.addr)
+	if err != nil {
+		return err
+	}
+
+	rc := mc.attachClient("timeshift", created)
+	defer mc.detachClient(rc)
+
+	// the data before now is not buffered, or it would be timestamped wrong
+	rc.live()
+
+	for {
+		select {
+		case <-rc.ready():
+			if err := tb.write(rc.read(), time.Now()); err != nil {
+				return err
+			}
+		case <-rc.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// run keeps receiving data from the multicast connection, it re-connects
+// if the connection is closed.
+func (tb *timeshiftBuffer) run() {
+	if err := tb.rotate(time.Now()); err != nil {
+		slog.Error(
+			"failed to create timeshift segment",
+			slog.String("multicastAddress", tb.addr),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	for {
+		if err := tb.receive(); err != nil {
+			slog.Error(
+				"timeshift buffer stopped",
+				slog.String("multicastAddress", tb.addr),
+				slog.String("error", err.Error()),
+			)
+		}
+		time.Sleep(time.Duration(getConfig().ReadTimeout) * time.Millisecond)
+	}
+}
+
+// seek returns the latest playback point which is not later than 't'
+func (tb *timeshiftBuffer) seek(t time.Time) (timeshiftPoint, bool) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	if len(tb.points) == 0 {
+		return timeshiftPoint{}, false
+	}
+
+	for i := len(tb.points) - 1; i > 0; i-- {
+		if !tb.points[i].time.After(t) {
+			return tb.points[i], true
+		}
+	}
+	return tb.points[0], true
+}
+
+// nextSegment returns the segment after 'seg', and whether 'seg' is the
+// segment being written.
+func (tb *timeshiftBuffer) nextSegment(seg *timeshiftSegment) (*timeshiftSegment, bool) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	for _, s := range tb.segments {
+		if s.start.After(seg.start) {
+			return s, false
+		}
+	}
+	return nil, true
+}
+
+// segmentSize returns the size of data written to the segment
+func (tb *timeshiftBuffer) segmentSize(seg *timeshiftSegment) int64 {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	return seg.size
+}
+
+// play writes the data from the playback point to the client, it is paced by
+// the PCR like a live stream, instead of sending the whole backlog at once.
+// Pausing is controlled by the client, as the write blocks if it does not
+// read.
+func (tb *timeshiftBuffer) play(w http.ResponseWriter, r *http.Request, pt timeshiftPoint) error {
+	tb.lock.Lock()
+	psi := tb.psi
+	tb.lock.Unlock()
+	if _, err := w.Write(psi); err != nil {
+		return err
+	}
+
+	seg, offset := pt.seg, pt.offset
+	buf := make([]byte, max(getConfig().WriteBufferSize/tsPacketSize, 1)*tsPacketSize)
+	pacer := newPCRPacer()
+	ctrl := http.NewResponseController(w)
+
+	// write writes the data to the client, it waits for the PCRs in the
+	// data, the packets before a PCR are written before waiting for it
+	write := func(data []byte) error {
+		sent := 0
+		for i := 0; i+tsPacketSize <= len(data); i += tsPacketSize {
+			wait, ok := pacer.delay(data[i : i+tsPacketSize])
+			if !ok || wait == 0 {
+				continue
+			}
+			if _, err := w.Write(data[sent:i]); err != nil {
+				return err
+			}
+			if err := ctrl.Flush(); err != nil {
+				return err
+			}
+			sent = i
+			select {
+			case <-time.After(wait):
+			case <-r.Context().Done():
+				return r.Context().Err()
+			}
+		}
+		_, err := w.Write(data[sent:])
+		return err
+	}
+
+	for {
+		f, err := os.Open(seg.path)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return err
+		}
+
+		for {
+			// read only the data which has been completely written
+			notify := tb.wait()
+			limit := tb.segmentSize(seg) - offset
+			if limit == 0 {
+				next, writing := tb.nextSegment(seg)
+				if !writing {
+					seg, offset = next, 0
+					break
+				}
+				select {
+				case <-notify:
+					continue
+				case <-r.Context().Done():
+					f.Close()
+					return nil
+				}
+			}
+
+			n, err := f.Read(buf[:min(int64(len(buf)), limit)])
+			offset += int64(n)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			if err = write(buf[:n]); err != nil {
+				f.Close()
+				if r.Context().Err() != nil {
+					return nil
+				}
+				return err
+			}
+		}
+
+		f.Close()
+	}
+}
+
+// iptvTimeshift relays a multicast IPTV channel from the timeshift buffer,
+// 'offset' is the number of seconds before now, which should be negative.
+func iptvTimeshift(w http.ResponseWriter, r *http.Request, offset int) {
+	addr := r.PathValue("addr")
+	tb := getTimeshiftBuffer(addr)
+	if tb == nil {
+		http.Error(w, "timeshift is not enabled", http.StatusNotFound)
+		return
+	}
+
+	pt, ok := tb.seek(time.Now().Add(time.Duration(offset) * time.Second))
+	if !ok {
+		http.Error(w, "no data in timeshift buffer", http.StatusServiceUnavailable)
+		return
+	}
+
+	slog.Info(
+		"timeshift client added",
+		slog.String("multicastAddress", addr),
+		slog.String("clientAddress", r.RemoteAddr),
+		slog.Int("offset", offset),
+	)
+
+	w.Header().Set("Content-Type", "video/MP2T")
+	err := tb.play(w, r, pt)
+	if err != nil && !strings.HasSuffix(err.Error(), " write: broken pipe") {
+		slog.Error(
+			"failed to relay from timeshift buffer",
+			slog.String("multicastAddress", addr),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	slog.Info(
+		"timeshift client removed",
+		slog.String("multicastAddress", addr),
+		slog.String("clientAddress", r.RemoteAddr),
+	)
+}
+
+// timeshiftDirName returns the name of the buffer directory of a multicast
+// address, all characters other than letters, digits and dots are replaced
+// by underscores, e.g. '225.1.8.103:8002' is '225.1.8.103_8002'.
+func timeshiftDirName(addr string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '.' {
+			return r
+		}
+		return '_'
+	}, addr)
+}
+
+// initTimeshift starts the timeshift buffers of the configured addresses,
+// configuration changes take effect after the program is restarted.
+func initTimeshift() {
+	cfg := getConfig()
+	for _, addr := range cfg.TimeshiftAddrs {
+		// only multicast addresses are supported, and this also ensures the
+		// directory name is not something like '..'
+		if _, _, err := parseMcastAddr(addr); err != nil {
+			slog.Error(
+				"invalid timeshift address",
+				slog.String("address", addr),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		dir := filepath.Join(cfg.TimeshiftDir, timeshiftDirName(addr))
+
+		// remove data of the previous run
+		err := os.RemoveAll(dir)
+		if err == nil {
+			err = os.MkdirAll(dir, 0777)
+		}
+		if err != nil {
+			slog.Error(
+				"failed to create timeshift directory",
+				slog.String("directory", dir),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+
+		tb := &timeshiftBuffer{
+			addr:     addr,
+			dir:      dir,
+			duration: time.Duration(cfg.TimeshiftDuration) * time.Minute,
+			notify:   make(chan struct{}),
+			parser:   newTSPSIParser(),
+			pmts:     map[uint16][]byte{},
+		}
+		timeshiftBuffers[addr] = tb
+		go tb.run()
+
+		slog.Info("timeshift buffer started", slog.String("multicastAddress", addr))
+	}
+}
+
+// apiListTimeshiftBuffers lists all timeshift buffers and the time ranges
+// they cover
+func apiListTimeshiftBuffers(w http.ResponseWriter, r *http.Request) {
+	_ = r
+
+	type Buffer struct {
+		Addr string    `json:"addr"`
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+		Size int64     `json:"size"`
+	}
+
+	result := make([]Buffer, 0, len(timeshiftBuffers))
+	for _, tb := range timeshiftBuffers {
+		b := Buffer{Addr: tb.addr}
+		tb.lock.Lock()
+		if len(tb.points) > 0 {
+			b.From = tb.points[0].time
+			b.To = tb.points[len(tb.points)-1].time
+		}
+		for _, seg := range tb.segments {
+			b.Size += seg.size
+		}
+		tb.lock.Unlock()
+		result = append(result, b)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,114 @@
+package main
+
+const (
+	// tsPacketSize is the size of a MPEG-TS packet
+	tsPacketSize = 188
+
+	// tsSyncByte is the first byte of every MPEG-TS packet
+	tsSyncByte = 0x47
+
+	// PID of the program association table
+	tsPIDPAT = 0x0000
+
+	// PID of the null packets
+	tsPIDNull = 0x1FFF
+)
+
+// tsPID returns the PID of a MPEG-TS packet
+func tsPID(pkt []byte) uint16 {
+	return uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+}
+
+// tsPayloadUnitStart reports whether the 'payload_unit_start_indicator' of
+// a MPEG-TS packet is set
+func tsPayloadUnitStart(pkt []byte) bool {
+	return pkt[1]&0x40 != 0
+}
+
+// tsHasAdaptation reports whether a MPEG-TS packet has an adaptation field
+func tsHasAdaptation(pkt []byte) bool {
+	return pkt[3]&0x20 != 0 && pkt[4] > 0
+}
+
+// tsRandomAccess reports whether the 'random_access_indicator' of a MPEG-TS
+// packet is set, that's, the packet is the start of a key frame
+func tsRandomAccess(pkt []byte) bool {
+	return tsHasAdaptation(pkt) && pkt[5]&0x40 != 0
+}
+
+// tsPayload returns the payload of a MPEG-TS packet, it returns nil if the
+// packet does not have a payload
+func tsPayload(pkt []byte) []byte {
+	if pkt[3]&0x10 == 0 {
+		return nil
+	}
+	start := 4
+	if pkt[3]&0x20 != 0 {
+		start += 1 + int(pkt[4])
+	}
+	if start >= tsPacketSize {
+		return nil
+	}
+	return pkt[start:tsPacketSize]
+}
+
+// tsForEachPacket calls fn for each MPEG-TS packet in buf, it skips to the
+// next sync byte if the data is not aligned to packets.
+func tsForEachPacket(buf []byte, fn func(pkt []byte)) {
+	for len(buf) >= tsPacketSize {
+		if buf[0] != tsSyncByte {
+			buf = buf[1:]
+			continue
+		}
+		fn(buf[:tsPacketSize])
+		buf = buf[tsPacketSize:]
+	}
+}
+
+// tsPSISection returns the PSI section carried by a MPEG-TS packet, it only
+// handles sections that begin in this packet and fit in it, which is true
+// for almost all PATs and PMTs in IPTV streams.
+func tsPSISection(pkt []byte) []byte {
+	if !tsPayloadUnitStart(pkt) {
+		return nil
+	}
+
+	payload := tsPayload(pkt)
+	if len(payload) == 0 {
+		return nil
+	}
+
+	// skip the pointer field
+	ptr := int(payload[0])
+	if 1+ptr+3 > len(payload) {
+		return nil
+	}
+	sec := payload[1+ptr:]
+
+	secLen := int(sec[1]&0x0F)<<8 | int(sec[2])
+	if 3+secLen > len(sec) {
+		return nil
+	}
+	return sec[:3+secLen]
+}
+
+// tsParsePAT parses a PAT section and returns the map of program number to
+// PMT PID, it returns nil if the section is not a valid PAT
+func tsParsePAT(sec []byte) map[uint16]uint16 {
+	// table id of PAT is 0, and the section must at least contain the
+	// 8 bytes header and the 4 bytes CRC
+	if len(sec) < 12 || sec[0] != 0x00 {
+		return nil
+	}
+
+	programs := make(map[uint16]uint16)
+	for p := sec[8 : len(sec)-4]; len(p) >= 4; p = p[4:] {
+		num := uint16(p[0])<<8 | uint16(p[1])
+		pid := uint16(p[2]&0x1F)<<8 | uint16(p[3])
+		// program number 0 is the network PID, not a PMT
+		if num != 0 {
+			programs[num] = pid
+		}
+	}
+	return programs
+}
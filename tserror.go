@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// tsErrorPeriod is the period of the error history records
+	tsErrorPeriod = time.Minute
+
+	// tsErrorHistorySize is the max number of history records of a source
+	tsErrorHistorySize = 24 * 60
+
+	// tsPCRMaxInterval is the max interval between two PCRs of the same PID
+	// allowed by ISO/IEC 13818-1, in the 27MHz clock
+	tsPCRMaxInterval = 100 * 27000
+
+	// tsPCRWrap is the wraparound value of PCR
+	tsPCRWrap = (1 << 33) * 300
+)
+
+// tsErrorRecord is the error statistics of a transport stream in a period,
+// 'Time' is the start time of the period. The unit of 'PCRJitter' is
+// microsecond, it is the max difference between the PCR interval and the
+// arrival interval of the PCR packets.
+type tsErrorRecord struct {
+	Time       time.Time `json:"time"`
+	Packets    uint64    `json:"packets"`
+	CCErrors   uint64    `json:"ccErrors"`
+	TEIErrors  uint64    `json:"teiErrors"`
+	SyncErrors uint64    `json:"syncErrors"`
+	PCRErrors  uint64    `json:"pcrErrors"`
+	PCRJitter  int64     `json:"pcrJitter"`
+}
+
+// tsErrorStats is the error statistics of a relay connection, it could be
+// read by other goroutines while the stream is being received.
+type tsErrorStats struct {
+	packets    atomic.Uint64
+	ccErrors   atomic.Uint64
+	teiErrors  atomic.Uint64
+	syncErrors atomic.Uint64
+	pcrErrors  atomic.Uint64
+	pcrJitter  atomic.Int64
+}
+
+// tsPCRState is the last PCR of a PID and its arrival time
+type tsPCRState struct {
+	pcr     uint64
+	arrival time.Time
+}
+
+// tsErrorAnalyzer checks the continuity counter, transport error indicator,
+// sync byte and PCR of the packets of a transport stream, it should only be
+// used by one goroutine.
+type tsErrorAnalyzer struct {
+	addr  string
+	stats tsErrorStats
+
+	// the last continuity counter plus 1 of each PID, 0 means unknown
+	ccs  [tsPIDNull + 1]uint8
+	pcrs map[uint16]tsPCRState
+
+	// the statistics of the current period
+	period tsErrorRecord
+	now    time.Time
+}
+
+func newTSErrorAnalyzer(addr string) *tsErrorAnalyzer {
+	return &tsErrorAnalyzer{
+		addr:   addr,
+		pcrs:   map[uint16]tsPCRState{},
+		period: tsErrorRecord{Time: time.Now()},
+	}
+}
+
+// tsPCR returns the PCR of a MPEG-TS packet in the 27MHz clock, the returned
+// bool is false if the packet does not carry a PCR
+func tsPCR(pkt []byte) (uint64, bool) {
+	if !tsHasAdaptation(pkt) || pkt[4] < 7 || pkt[5]&0x10 == 0 {
+		return 0, false
+	}
+	base := uint64(pkt[6])<<25 | uint64(pkt[7])<<17 | uint64(pkt[8])<<9 |
+		uint64(pkt[9])<<1 | uint64(pkt[10])>>7
+	ext := uint64(pkt[10]&0x01)<<8 | uint64(pkt[11])
+	return base*300 + ext, true
+}
+
+// tsDiscontinuity reports whether the 'discontinuity_indicator' of a MPEG-TS
+// packet is set
+func tsDiscontinuity(pkt []byte) bool {
+	return tsHasAdaptation(pkt) && pkt[5]&0x80 != 0
+}
+
+// handle checks the data received from the source at the same time, it
+// should be aligned to packets.
+func (a *tsErrorAnalyzer) handle(data []byte) {
+	a.now = time.Now()
+	if a.now.Sub(a.period.Time) >= tsErrorPeriod {
+		a.flush()
+	}
+
+	for len(data) > 0 {
+		if len(data) < tsPacketSize || data[0] != tsSyncByte {
+			a.period.SyncErrors++
+			a.stats.syncErrors.Add(1)
+			data = data[min(len(data), tsPacketSize):]
+			continue
+		}
+		a.handlePacket(data[:tsPacketSize])
+		data = data[tsPacketSize:]
+	}
+}
+
+func (a *tsErrorAnalyzer) handlePacket(pkt []byte) {
+	a.period.Packets++
+	a.stats.packets.Add(1)
+
+	// other fields are not reliable if the packet is corrupted
+	if pkt[1]&0x80 != 0 {
+		a.period.TEIErrors++
+		a.stats.teiErrors.Add(1)
+		return
+	}
+
+	pid := tsPID(pkt)
+	if pid == tsPIDNull {
+		return
+	}
+
+	discontinuity := tsDiscontinuity(pkt)
+
+	// the continuity counter is only incremented for packets with payload,
+	// and a packet could be sent twice
+	if pkt[3]&0x10 != 0 {
+		cc := pkt[3] & 0x0F
+		if last := a.ccs[pid]; last != 0 && !discontinuity {
+			prev := last - 1
+			if cc != (prev+1)&0x0F && cc != prev {
+				a.period.CCErrors++
+				a.stats.ccErrors.Add(1)
+			}
+		}
+		a.ccs[pid] = cc + 1
+	}
+
+	pcr, ok := tsPCR(pkt)
+	if !ok {
+		return
+	}
+
+	last, ok := a.pcrs[pid]
+	a.pcrs[pid] = tsPCRState{pcr: pcr, arrival: a.now}
+	if !ok || discontinuity {
+		return
+	}
+
+	interval := (pcr + tsPCRWrap - last.pcr) % tsPCRWrap
+	if interval > tsPCRMaxInterval {
+		a.period.PCRErrors++
+		a.stats.pcrErrors.Add(1)
+		return
+	}
+
+	jitter := time.Duration(interval*1000/27) - a.now.Sub(last.arrival)
+	jitter = max(jitter, -jitter)
+	us := jitter.Microseconds()
+	a.period.PCRJitter = max(a.period.PCRJitter, us)
+	if us > a.stats.pcrJitter.Load() {
+		a.stats.pcrJitter.Store(us)
+	}
+}
+
+// flush saves the statistics of the current period to the history, and
+// starts a new period
+func (a *tsErrorAnalyzer) flush() {
+	if a.period.Packets > 0 || a.period.SyncErrors > 0 {
+		addTSErrorRecord(a.addr, a.period)
+	}
+	a.period = tsErrorRecord{Time: a.now}
+}
+
+var (
+	// tsErrorHistory is the error history of sources, the key is the address
+	// of the source
+	tsErrorHistory     = map[string][]tsErrorRecord{}
+	tsErrorHistoryLock sync.Mutex
+)
+
+// addTSErrorRecord adds a record to the history of the source, and removes
+// the records which are too old from all sources
+func addTSErrorRecord(addr string, rec tsErrorRecord) {
+	tsErrorHistoryLock.Lock()
+	defer tsErrorHistoryLock.Unlock()
+
+	expire := time.Now().Add(-tsErrorHistorySize * tsErrorPeriod)
+	for k, list := range tsErrorHistory {
+		i := 0
+		for i < len(list) && list[i].Time.Before(expire) {
+			i++
+		}
+		if i == len(list) {
+			delete(tsErrorHistory, k)
+		} else if i > 0 {
+			tsErrorHistory[k] = slices.Clone(list[i:])
+		}
+	}
+
+	list := append(tsErrorHistory[addr], rec)
+	if len(list) > tsErrorHistorySize {
+		list = slices.Clone(list[len(list)-tsErrorHistorySize:])
+	}
+	tsErrorHistory[addr] = list
+}
+
+// apiListTSErrorHistory lists the transport stream error history of all
+// sources, or the source specified by query parameter 'source'
+func apiListTSErrorHistory(w http.ResponseWriter, r *http.Request) {
+	source := r.URL.Query().Get("source")
+
+	result := map[string][]tsErrorRecord{}
+	tsErrorHistoryLock.Lock()
+	for addr, list := range tsErrorHistory {
+		if source == "" || source == addr {
+			result[addr] = slices.Clone(list)
+		}
+	}
+	tsErrorHistoryLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(result)
+}
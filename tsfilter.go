@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// tsAudioStreamTypes is the set of stream types which are audio streams, AC-3
+// and E-AC-3 streams with stream type 0x06 are recognized by their codec
+var tsAudioStreamTypes = map[byte]bool{
+	0x03: true,
+	0x04: true,
+	0x0F: true,
+	0x11: true,
+	0x81: true,
+	0x87: true,
+}
+
+// tsProgramSelector selects a program of a multi-program transport stream,
+// and optionally an audio track of the program by its language
+type tsProgramSelector struct {
+	// program is the program number, 0 means the first program in the PAT
+	program uint16
+	audio   string
+}
+
+// parseProgramSelector parses the 'program' and 'audio' query parameters,
+// it returns nil if neither of them is specified
+func parseProgramSelector(q url.Values) (*tsProgramSelector, error) {
+	prog, audio := q.Get("program"), q.Get("audio")
+	if prog == "" && audio == "" {
+		return nil, nil
+	}
+
+	sel := &tsProgramSelector{audio: strings.ToLower(audio)}
+	if prog != "" {
+		n, err := strconv.ParseUint(prog, 10, 16)
+		if err != nil || n == 0 {
+			return nil, errors.New("invalid program")
+		}
+		sel.program = uint16(n)
+	}
+	return sel, nil
+}
+
+// find returns the selected program in the stream information, or nil if
+// it is not found
+func (sel *tsProgramSelector) find(info *tsStreamInfo) *tsProgram {
+	var first *tsProgram
+	for i := range info.Programs {
+		prog := &info.Programs[i]
+		if prog.Number == sel.program {
+			return prog
+		}
+		if first == nil || prog.Number < first.Number {
+			first = prog
+		}
+	}
+	if sel.program == 0 {
+		return first
+	}
+	return nil
+}
+
+// tsProgramFilter passes through only the PIDs of the selected program, and
+// rewrites the PAT and PMT to remove the other programs and streams. It has
+// its own PSI parsing so that each client could have its own filter.
+type tsProgramFilter struct {
+	sel  *tsProgramSelector
+	addr string
+
+	// program and pmtPID are the number and the PMT PID of the selected
+	// program, pids is the set of the PIDs to pass through, and pkt is the
+	// buffer of the rewritten PAT or PMT packet
+	program uint16
+	pmtPID  uint16
+	pids    map[uint16]bool
+	pkt     [tsPacketSize]byte
+
+	// missing is set when the selected program is not in the PAT, so that
+	// it is only logged once
+	missing bool
+}
+
+func newTSProgramFilter(sel *tsProgramSelector, addr string) *tsProgramFilter {
+	return &tsProgramFilter{
+		sel:    sel,
+		addr:   addr,
+		pmtPID: tsPIDNull,
+		pids:   map[uint16]bool{},
+	}
+}
+
+// filter removes the packets in place and returns the remaining data, the
+// packets before the first PMT of the selected program are all removed
+func (f *tsProgramFilter) filter(buf []byte) []byte {
+	out := buf[:0]
+	tsForEachPacket(buf, func(pkt []byte) {
+		pid := tsPID(pkt)
+		switch {
+		case pid == tsPIDPAT:
+			if sec := tsPSISection(pkt); sec != nil && tsCRC32(sec) == 0 && f.handlePAT(sec) {
+				out = append(out, f.rewrite(pkt)...)
+			}
+		case pid == f.pmtPID:
+			if sec := tsPSISection(pkt); sec != nil && tsCRC32(sec) == 0 && f.handlePMT(sec) {
+				out = append(out, f.rewrite(pkt)...)
+			}
+		case f.pids[pid]:
+			out = append(out, pkt...)
+		}
+	})
+	return out
+}
+
+// handlePAT selects the program from a PAT section, and builds the section
+// of the rewritten PAT in 'f.pkt', it returns false if the program is not
+// found.
+func (f *tsProgramFilter) handlePAT(sec []byte) bool {
+	programs := tsParsePAT(sec)
+	if programs == nil {
+		return false
+	}
+
+	num := f.sel.program
+	if num == 0 {
+		for n := range programs {
+			if num == 0 || n < num {
+				num = n
+			}
+		}
+	}
+
+	pmtPID, ok := programs[num]
+	if !ok {
+		if !f.missing {
+			f.missing = true
+			slog.Warn(
+				"program not found in the stream",
+				slog.String("address", f.addr),
+				slog.Int("program", int(f.sel.program)),
+			)
+		}
+		return false
+	}
+	f.missing = false
+
+	if pmtPID != f.pmtPID {
+		f.pmtPID = pmtPID
+		clear(f.pids)
+	}
+	f.program = num
+
+	// header of the original section (table ID, section length, transport
+	// stream ID, version, section numbers), the only program, and the CRC
+	newSec := append(f.section()[:0], sec[:8]...)
+	newSec = append(newSec, byte(num>>8), byte(num), 0xE0|byte(pmtPID>>8), byte(pmtPID))
+	f.finish(newSec)
+	return true
+}
+
+// handlePMT selects the streams from a PMT section of the selected program,
+// and builds the section of the rewritten PMT in 'f.pkt', it returns false
+// if the section is invalid.
+func (f *tsProgramFilter) handlePMT(sec []byte) bool {
+	if len(sec) < 16 || sec[0] != 0x02 || uint16(sec[3])<<8|uint16(sec[4]) != f.program {
+		return false
+	}
+	infoLen := int(sec[10]&0x0F)<<8 | int(sec[11])
+	if 12+infoLen > len(sec)-4 {
+		return false
+	}
+
+	// the entries of the elementary streams, and whether they are selected
+	var (
+		entries  [][]byte
+		selected []bool
+		audio    = -1
+		matched  = false
+	)
+	for es := sec[12+infoLen : len(sec)-4]; len(es) >= 5; {
+		esInfoLen := int(es[3]&0x0F)<<8 | int(es[4])
+		if 5+esInfoLen > len(es) {
+			break
+		}
+		entry := es[:5+esInfoLen]
+		es = es[5+esInfoLen:]
+
+		s := tsParseElementaryStream(entry)
+		keep := false
+		switch {
+		case tsVideoStreamTypes[s.StreamType]:
+			keep = true
+		case tsAudioStreamTypes[s.StreamType] || s.Codec == "AC-3" || s.Codec == "E-AC-3":
+			// all audio tracks are kept if no language is specified,
+			// otherwise the tracks of the language, or the first track if
+			// no track is of the language
+			keep = f.sel.audio == "" || strings.ToLower(s.Language) == f.sel.audio
+			matched = matched || keep
+			if audio < 0 {
+				audio = len(entries)
+			}
+		case s.Codec == "DVB Subtitle" || s.Codec == "Teletext":
+			keep = true
+		}
+		entries = append(entries, entry)
+		selected = append(selected, keep)
+	}
+	if !matched && audio >= 0 {
+		selected[audio] = true
+	}
+
+	clear(f.pids)
+	f.pids[uint16(sec[8]&0x1F)<<8|uint16(sec[9])] = true
+
+	newSec := append(f.section()[:0], sec[:12+infoLen]...)
+	for i, entry := range entries {
+		if selected[i] {
+			f.pids[uint16(entry[1]&0x1F)<<8|uint16(entry[2])] = true
+			newSec = append(newSec, entry...)
+		}
+	}
+	f.finish(newSec)
+	return true
+}
+
+// section returns the buffer for the section of the rewritten packet, it is
+// after the 4 bytes header and the pointer field of 'f.pkt'
+func (f *tsProgramFilter) section() []byte {
+	return f.pkt[5:5]
+}
+
+// finish updates the section length and appends the CRC of a section built
+// in 'f.pkt', and pads the rest of the packet with stuffing bytes
+func (f *tsProgramFilter) finish(sec []byte) {
+	secLen := len(sec) + 4 - 3
+	sec[1] = sec[1]&0xF0 | byte(secLen>>8)
+	sec[2] = byte(secLen)
+	crc := tsCRC32(sec)
+	sec = append(sec, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	for i := 5 + len(sec); i < tsPacketSize; i++ {
+		f.pkt[i] = 0xFF
+	}
+}
+
+// rewrite returns the rewritten packet of 'pkt' whose section is built in
+// 'f.pkt', the header is copied from 'pkt' without the adaptation field
+func (f *tsProgramFilter) rewrite(pkt []byte) []byte {
+	f.pkt[0], f.pkt[1], f.pkt[2] = pkt[0], pkt[1], pkt[2]
+	f.pkt[3] = pkt[3]&0xC0 | 0x10 | pkt[3]&0x0F
+	f.pkt[4] = 0
+	return f.pkt[:]
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+const (
+	// PID of the service description table
+	tsPIDSDT = 0x0011
+
+	tsTableIDPAT = 0x00
+	tsTableIDPMT = 0x02
+	tsTableIDSDT = 0x42 // SDT of the actual transport stream
+)
+
+// tsCRCTable is the lookup table of CRC32/MPEG-2
+var tsCRCTable = func() (tbl [256]uint32) {
+	for i := range tbl {
+		crc := uint32(i) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		tbl[i] = crc
+	}
+	return
+}()
+
+// tsCRC32 calculates the CRC32/MPEG-2 of data, the result is 0 if data is
+// a PSI section with a correct CRC.
+func tsCRC32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc = crc<<8 ^ tsCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// tsStreamTypes maps stream types in PMT to codec names
+var tsStreamTypes = map[byte]string{
+	0x01: "MPEG-1 Video",
+	0x02: "MPEG-2 Video",
+	0x03: "MPEG-1 Audio",
+	0x04: "MPEG-2 Audio",
+	0x0F: "AAC",
+	0x11: "AAC LATM",
+	0x15: "Metadata",
+	0x1B: "H.264",
+	0x24: "H.265",
+	0x42: "AVS",
+	0x81: "AC-3",
+	0x87: "E-AC-3",
+	0xD2: "AVS2",
+}
+
+// tsVideoStreamTypes is the set of stream types which are video streams
+var tsVideoStreamTypes = map[byte]bool{
+	0x01: true,
+	0x02: true,
+	0x1B: true,
+	0x24: true,
+	0x42: true,
+	0xD2: true,
+}
+
+// tsElementaryStream is an elementary stream in a program
+type tsElementaryStream struct {
+	PID        uint16 `json:"pid"`
+	StreamType byte   `json:"streamType"`
+	Codec      string `json:"codec"`
+	Language   string `json:"language,omitempty"`
+}
+
+// tsProgram is a program in a transport stream
+type tsProgram struct {
+	Number       uint16               `json:"number"`
+	PMTPID       uint16               `json:"pmtPID"`
+	PCRPID       uint16               `json:"pcrPID"`
+	ServiceName  string               `json:"serviceName,omitempty"`
+	ProviderName string               `json:"providerName,omitempty"`
+	Streams      []tsElementaryStream `json:"streams"`
+}
+
+// tsStreamInfo is the information of a transport stream
+type tsStreamInfo struct {
+	TransportStreamID uint16      `json:"transportStreamID"`
+	Programs          []tsProgram `json:"programs"`
+}
+
+// tsService is the names of a service in SDT
+type tsService struct {
+	name     string
+	provider string
+}
+
+// tsPSIParser parses PAT, PMT and SDT of a transport stream, it should only
+// be used by one goroutine, but the parsed information could be read by
+// other goroutines via 'info'.
+type tsPSIParser struct {
+	// partial sections, the key is PID
+	partials map[uint16][]byte
+
+	// CRC of the last parsed sections, used to skip unchanged sections, the
+	// key is the combination of PID, table ID and section number
+	crcs map[uint32]uint32
+
+	tsID     uint16
+	pmtPIDs  map[uint16]uint16 // PMT PID to program number
+	programs map[uint16]*tsProgram
+	services map[uint16]tsService
+
+	// PIDs of all video streams, rebuilt when the information is published
+	videoPIDs map[uint16]bool
+
+	info atomic.Pointer[tsStreamInfo]
+}
+
+func newTSPSIParser() *tsPSIParser {
+	return &tsPSIParser{
+		partials:  map[uint16][]byte{},
+		crcs:      map[uint32]uint32{},
+		pmtPIDs:   map[uint16]uint16{},
+		programs:  map[uint16]*tsProgram{},
+		services:  map[uint16]tsService{},
+		videoPIDs: map[uint16]bool{},
+	}
+}
+
+// getInfo returns the parsed stream information, or nil if PAT has not been
+// received yet.
+func (p *tsPSIParser) getInfo() *tsStreamInfo {
+	return p.info.Load()
+}
+
+// isPMTPID reports whether pid is the PID of a PMT
+func (p *tsPSIParser) isPMTPID(pid uint16) bool {
+	_, ok := p.pmtPIDs[pid]
+	return ok
+}
+
+// isVideoPID reports whether pid is the PID of a video stream, it returns
+// true for all PIDs if no video stream is known yet.
+func (p *tsPSIParser) isVideoPID(pid uint16) bool {
+	return len(p.videoPIDs) == 0 || p.videoPIDs[pid]
+}
+
+// assemble collects the payload of a packet, and returns a section if it is
+// complete. Only one section is returned even if the packet contains more,
+// this is fine for the PSI tables we are interested in.
+func (p *tsPSIParser) assemble(pid uint16, pkt []byte) []byte {
+	payload := tsPayload(pkt)
+	if len(payload) == 0 {
+		return nil
+	}
+
+	buf := p.partials[pid]
+	if tsPayloadUnitStart(pkt) {
+		ptr := int(payload[0])
+		if 1+ptr >= len(payload) {
+			return nil
+		}
+		buf = append(buf[:0], payload[1+ptr:]...)
+	} else if len(buf) > 0 {
+		buf = append(buf, payload...)
+	} else {
+		return nil
+	}
+
+	if len(buf) >= 3 {
+		secLen := 3 + (int(buf[1]&0x0F)<<8 | int(buf[2]))
+		if len(buf) >= secLen {
+			p.partials[pid] = buf[:0]
+			if secLen < 12 || tsCRC32(buf[:secLen]) != 0 {
+				return nil
+			}
+			return buf[:secLen]
+		}
+	}
+
+	p.partials[pid] = buf
+	return nil
+}
+
+// handlePacket handles a MPEG-TS packet
+func (p *tsPSIParser) handlePacket(pkt []byte) {
+	pid := tsPID(pkt)
+	if pid != tsPIDPAT && pid != tsPIDSDT && !p.isPMTPID(pid) {
+		return
+	}
+
+	sec := p.assemble(pid, pkt)
+	if sec == nil {
+		return
+	}
+
+	// skip the section if it is not changed
+	key := uint32(pid)<<16 | uint32(sec[0])<<8 | uint32(sec[6])
+	crc := uint32(sec[len(sec)-4])<<24 | uint32(sec[len(sec)-3])<<16 |
+		uint32(sec[len(sec)-2])<<8 | uint32(sec[len(sec)-1])
+	if c, ok := p.crcs[key]; ok && c == crc {
+		return
+	}
+
+	var changed bool
+	switch {
+	case pid == tsPIDPAT && sec[0] == tsTableIDPAT:
+		changed = p.parsePAT(sec)
+	case pid == tsPIDSDT && sec[0] == tsTableIDSDT:
+		changed = p.parseSDT(sec)
+	case sec[0] == tsTableIDPMT:
+		changed = p.parsePMT(pid, sec)
+	}
+
+	if changed {
+		p.crcs[key] = crc
+		p.publish()
+	}
+}
+
+func (p *tsPSIParser) parsePAT(sec []byte) bool {
+	programs := tsParsePAT(sec)
+	if programs == nil {
+		return false
+	}
+
+	p.tsID = uint16(sec[3])<<8 | uint16(sec[4])
+	clear(p.pmtPIDs)
+	for num, pid := range programs {
+		p.pmtPIDs[pid] = num
+		if prog := p.programs[num]; prog == nil || prog.PMTPID != pid {
+			p.programs[num] = &tsProgram{Number: num, PMTPID: pid}
+		}
+	}
+	for num := range p.programs {
+		if _, ok := programs[num]; !ok {
+			delete(p.programs, num)
+		}
+	}
+
+	// PMTs should be parsed again as the PIDs may be changed
+	for key := range p.crcs {
+		if key>>16 != tsPIDPAT && key>>16 != tsPIDSDT {
+			delete(p.crcs, key)
+		}
+	}
+	return true
+}
+
+func (p *tsPSIParser) parsePMT(pid uint16, sec []byte) bool {
+	num := uint16(sec[3])<<8 | uint16(sec[4])
+	prog := p.programs[num]
+	if prog == nil || prog.PMTPID != pid || len(sec) < 16 {
+		return false
+	}
+
+	prog.PCRPID = uint16(sec[8]&0x1F)<<8 | uint16(sec[9])
+	prog.Streams = prog.Streams[:0]
+
+	infoLen := int(sec[10]&0x0F)<<8 | int(sec[11])
+	if 12+infoLen > len(sec)-4 {
+		return false
+	}
+
+	for es := sec[12+infoLen : len(sec)-4]; len(es) >= 5; {
+		esInfoLen := int(es[3]&0x0F)<<8 | int(es[4])
+		if 5+esInfoLen > len(es) {
+			break
+		}
+		prog.Streams = append(prog.Streams, tsParseElementaryStream(es[:5+esInfoLen]))
+		es = es[5+esInfoLen:]
+	}
+
+	return true
+}
+
+// tsParseElementaryStream parses an elementary stream entry in PMT
+func tsParseElementaryStream(es []byte) tsElementaryStream {
+	s := tsElementaryStream{
+		StreamType: es[0],
+		PID:        uint16(es[1]&0x1F)<<8 | uint16(es[2]),
+		Codec:      tsStreamTypes[es[0]],
+	}
+
+	for desc := es[5:]; len(desc) >= 2; {
+		tag, l := desc[0], int(desc[1])
+		if 2+l > len(desc) {
+			break
+		}
+		data := desc[2 : 2+l]
+		desc = desc[2+l:]
+
+		switch tag {
+		case 0x0A: // ISO 639 language descriptor
+			if len(data) >= 3 {
+				s.Language = string(data[:3])
+			}
+		case 0x6A: // AC-3 descriptor
+			if s.StreamType == 0x06 {
+				s.Codec = "AC-3"
+			}
+		case 0x7A: // enhanced AC-3 descriptor
+			if s.StreamType == 0x06 {
+				s.Codec = "E-AC-3"
+			}
+		case 0x56: // teletext descriptor
+			if s.StreamType == 0x06 {
+				s.Codec = "Teletext"
+			}
+		case 0x59: // subtitling descriptor
+			if s.StreamType == 0x06 {
+				s.Codec = "DVB Subtitle"
+			}
+			if len(data) >= 3 {
+				s.Language = string(data[:3])
+			}
+		}
+	}
+
+	if s.Codec == "" {
+		s.Codec = "Unknown"
+	}
+	return s
+}
+
+func (p *tsPSIParser) parseSDT(sec []byte) bool {
+	if len(sec) < 15 {
+		return false
+	}
+
+	for svc := sec[11 : len(sec)-4]; len(svc) >= 5; {
+		id := uint16(svc[0])<<8 | uint16(svc[1])
+		loopLen := int(svc[3]&0x0F)<<8 | int(svc[4])
+		if 5+loopLen > len(svc) {
+			break
+		}
+
+		for desc := svc[5 : 5+loopLen]; len(desc) >= 2; {
+			tag, l := desc[0], int(desc[1])
+			if 2+l > len(desc) {
+				break
+			}
+			data := desc[2 : 2+l]
+			desc = desc[2+l:]
+
+			// service descriptor
+			if tag != 0x48 || len(data) < 2 {
+				continue
+			}
+			pl := int(data[1])
+			if 2+pl >= len(data) {
+				continue
+			}
+			nl := int(data[2+pl])
+			if 3+pl+nl > len(data) {
+				continue
+			}
+			p.services[id] = tsService{
+				provider: dvbString(data[2 : 2+pl]),
+				name:     dvbString(data[3+pl : 3+pl+nl]),
+			}
+		}
+
+		svc = svc[5+loopLen:]
+	}
+
+	return true
+}
+
+// publish builds the stream information from the parsed tables, and stores
+// it for other goroutines to read
+func (p *tsPSIParser) publish() {
+	info := &tsStreamInfo{
+		TransportStreamID: p.tsID,
+		Programs:          make([]tsProgram, 0, len(p.programs)),
+	}
+
+	clear(p.videoPIDs)
+	for _, prog := range p.programs {
+		for _, es := range prog.Streams {
+			if tsVideoStreamTypes[es.StreamType] {
+				p.videoPIDs[es.PID] = true
+			}
+		}
+
+		np := *prog
+		np.Streams = slices.Clone(prog.Streams)
+		if svc, ok := p.services[prog.Number]; ok {
+			np.ServiceName = svc.name
+			np.ProviderName = svc.provider
+		}
+		info.Programs = append(info.Programs, np)
+	}
+
+	slices.SortFunc(info.Programs, func(a, b tsProgram) int {
+		return int(a.Number) - int(b.Number)
+	})
+
+	p.info.Store(info)
+}
+
+// dvbString converts a DVB string to a Go string. Only UTF-8 and ISO-8859-1
+// are supported, as we don't want to add a dependency for other character
+// tables, strings in other character tables are kept as is if they are valid
+// UTF-8 strings, or converted as ISO-8859-1 strings.
+func dvbString(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+
+	// the first byte selects the character table if it is less than 0x20
+	if data[0] == 0x10 && len(data) >= 3 {
+		data = data[3:]
+	} else if data[0] == 0x1F && len(data) >= 2 {
+		data = data[2:]
+	} else if data[0] < 0x20 {
+		data = data[1:]
+	}
+
+	if utf8.Valid(data) {
+		return string(data)
+	}
+
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// apiGetRelayInfo returns the stream information of a relay connection
+func apiGetRelayInfo(w http.ResponseWriter, r *http.Request) {
+	addr := r.PathValue("addr")
+	v, ok := mcastConns.Load(addr)
+	if !ok {
+		http.Error(w, "relay connection not found", http.StatusNotFound)
+		return
+	}
+
+	info := v.(*mcastConn).psi.getInfo()
+	if info == nil {
+		http.Error(w, "stream information not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// udpxyStatusTemplate is the template of the status page, it is similar to
+// the status page of udpxy
+var udpxyStatusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>MyIPTV status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #999; padding: 4px 8px; text-align: left; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<h3>MyIPTV {{.Version}}</h3>
+<p>Server address: {{.ServerAddr}}, multicast interface: {{.McastIface}}</p>
+<p>Active sources: {{len .Conns}}, active clients: {{.ClientCount}}</p>
+<table>
+<tr><th>Source</th><th>Destination</th><th>Since</th></tr>
+{{- range .Conns}}{{$src := .Addr}}
+{{- range .Clients}}
+<tr><td>{{$src}}</td><td>{{.Addr}}</td><td>{{.CreatedAt.Format "2006-01-02 15:04:05"}}</td></tr>
+{{- end}}
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// udpxyStatus is a udpxy-style status page, which lists the active sources
+// and their clients
+func udpxyStatus(w http.ResponseWriter, r *http.Request) {
+	_ = r
+
+	type Client struct {
+		Addr      string
+		CreatedAt time.Time
+	}
+
+	type Conn struct {
+		Addr    string
+		Clients []Client
+	}
+
+	cfg := getConfig()
+	data := struct {
+		Version     string
+		ServerAddr  string
+		McastIface  string
+		ClientCount int
+		Conns       []Conn
+	}{
+		Version:    Version,
+		ServerAddr: cfg.ServerAddr,
+		McastIface: cfg.McastIface,
+	}
+
+	mcastConns.Range(func(k, v any) bool {
+		mc := v.(*mcastConn)
+		conn := Conn{Addr: mc.addr}
+		for _, rc := range mc.getClients() {
+			if rc == nil {
+				continue
+			}
+			conn.Clients = append(conn.Clients, Client{
+				Addr:      rc.addr,
+				CreatedAt: rc.createdAt,
+			})
+		}
+		data.ClientCount += len(conn.Clients)
+		data.Conns = append(data.Conns, conn)
+		return true
+	})
+
+	slices.SortFunc(data.Conns, func(a, b Conn) int {
+		return strings.Compare(a.Addr, b.Addr)
+	})
+
+	w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+	if err := udpxyStatusTemplate.Execute(w, &data); err != nil {
+		slog.Error(
+			"failed to render status page",
+			slog.String("error", err.Error()),
+		)
+	}
+}
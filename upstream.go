@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pullMaxFailures is the max number of consecutive failed connections to an
+// upstream, the relay connection is closed after that, so that the channel
+// relay could switch to another source.
+const pullMaxFailures = 3
+
+// upstreamReadSize is the max size of data read from a HTTP upstream at once,
+// it is also the max size of a write to the relay buffer
+const upstreamReadSize = tsPacketSize * 64
+
+// errNotMPEGTS is returned if the response of a HTTP upstream is not a MPEG
+// TS stream, e.g. HLS or FLV, these sources are passed through to clients
+// instead of being relayed.
+var errNotMPEGTS = errors.New("upstream is not a MPEG TS stream")
+
+// nonTSSources is the set of HTTP sources whose response was found not to be
+// a MPEG TS stream
+var nonTSSources sync.Map
+
+// nonTSExts are the path extensions of HTTP sources which are known not to
+// be MPEG TS streams, so they are passed through without a try.
+var nonTSExts = []string{".m3u8", ".m3u", ".flv", ".mp4", ".mpd"}
+
+// isNonTSSource reports whether a HTTP source should be passed through to
+// clients instead of being relayed
+func isNonTSSource(src string) bool {
+	if !isHTTPSource(src) {
+		return false
+	}
+	if _, ok := nonTSSources.Load(src); ok {
+		return true
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	for _, e := range nonTSExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// isTSResponse reports whether the response of a HTTP upstream is a MPEG TS
+// stream, by its content type, or by the sync bytes of the first packets if
+// the content type is not specific, e.g. 'application/octet-stream' of udpxy.
+// 'head' is the beginning of the body read for the check.
+func isTSResponse(resp *http.Response) (bool, []byte, error) {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if strings.EqualFold(mt, "video/MP2T") {
+		return true, nil, nil
+	}
+
+	// a short response is checked with the data received
+	head := make([]byte, tsPacketSize*3)
+	n, err := io.ReadFull(resp.Body, head)
+	if n == 0 {
+		return false, nil, err
+	}
+	head = head[:n]
+	for i := 0; i < len(head); i += tsPacketSize {
+		if head[i] != tsSyncByte {
+			return false, nil, nil
+		}
+	}
+	return true, head, nil
+}
+
+// upstreamInput pulls the stream from a HTTP or RTSP upstream
+type upstreamInput struct {
+	// pullOnce connects to the upstream and relays the stream until it ends,
+	// see 'pullHTTP' for its return values
+	pullOnce func(mc *mcastConn) (int64, bool, error)
+}
+
+// newUpstreamInput creates the input of a HTTP or RTSP upstream, the
+// connection to the upstream is established in 'receive'.
+func newUpstreamInput(addr string) (*upstreamInput, error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		slog.Error("invalid upstream source", slog.String("address", addr))
+		return nil, errInvalidMcastAddr
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &upstreamInput{pullOnce: (*mcastConn).pullHTTP}, nil
+	case "rtsp":
+		return &upstreamInput{pullOnce: (*mcastConn).pullRTSP}, nil
+	default:
+		slog.Error("unsupported upstream source", slog.String("address", addr))
+		return nil, errInvalidMcastAddr
+	}
+}
+
+// pullHTTP requests the HTTP upstream and relays the response to clients
+// until the response ends, fails or stalls, or all clients are gone. It
+// returns the number of bytes received, whether any client is alive, and
+// the reason why the response ends if any client is alive.
+func (mc *mcastConn) pullHTTP() (int64, bool, error) {
+	timeout := time.Duration(getConfig().SourceTimeout) * time.Millisecond
+	ctx, cancel := context.WithCancel(mc.ctx)
+	defer cancel()
+
+	// the request is canceled if no data is received within the timeout
+	watchdog := time.AfterFunc(timeout, cancel)
+	defer watchdog.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mc.addr, nil)
+	if err != nil {
+		return 0, true, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, true, errors.New(resp.Status)
+	}
+
+	isTS, head, err := isTSResponse(resp)
+	if err != nil {
+		return 0, true, err
+	}
+	if !isTS {
+		nonTSSources.Store(mc.addr, struct{}{})
+		slog.Warn(
+			"upstream is not a MPEG TS stream, it will be passed through",
+			slog.String("address", mc.addr),
+			slog.String("contentType", resp.Header.Get("Content-Type")),
+		)
+		return 0, true, errNotMPEGTS
+	}
+
+	// the response is a byte stream, but clients expect complete packets,
+	// so the incomplete packet at the end of a read is kept in the buffer
+	// until the remaining data is received.
+	buf := make([]byte, upstreamReadSize)
+	pending := copy(buf, head)
+	received := int64(pending)
+	for {
+		watchdog.Reset(timeout)
+		n, err := resp.Body.Read(buf[pending:])
+		received += int64(n)
+		data := buf[:pending+n]
+
+		// skip garbage before the first sync byte
+		if i := bytes.IndexByte(data, tsSyncByte); i < 0 {
+			data = data[:0]
+		} else {
+			data = data[i:]
+		}
+
+		size := len(data) - len(data)%tsPacketSize
+		if size > 0 && !mc.write(data[:size]) {
+			return received, false, nil
+		}
+		pending = copy(buf, data[size:])
+
+		if err != nil {
+			return received, true, err
+		}
+	}
+}
+
+// receive keeps pulling the stream from the upstream, it reconnects if the
+// upstream fails, until all clients are gone or it fails too many times.
+func (in *upstreamInput) receive(mc *mcastConn) {
+	failed := 0
+	for failed < pullMaxFailures {
+		n, alive, err := in.pullOnce(mc)
+		if !alive || mc.ctx.Err() != nil || errors.Is(err, errNotMPEGTS) {
+			break
+		}
+
+		if n > 0 {
+			failed = 0
+		}
+		failed++
+
+		slog.Warn(
+			"upstream failed, reconnecting",
+			slog.String("address", mc.addr),
+			slog.String("error", err.Error()),
+		)
+
+		select {
+		case <-time.After(time.Second):
+		case <-mc.ctx.Done():
+		}
+	}
+}
+
+func (in *upstreamInput) close() {
+}
@@ -13,7 +13,8 @@ func Date(tm time.Time) time.Time {
 }
 
 // GetInterfacesAndIPs returns a map of network interfaces and their
-// IP addresses. This function ignores all errors.
+// IP addresses, IPv4 addresses are listed before IPv6 addresses, link-local
+// IPv6 addresses are excluded. This function ignores all errors.
 func GetInterfacesAndIPs() map[string][]string {
 	m := make(map[string][]string)
 
@@ -37,17 +38,19 @@ func GetInterfacesAndIPs() map[string][]string {
 			continue
 		}
 		ips := make([]string, 0, len(addrs))
+		ip6s := make([]string, 0, len(addrs))
 		for _, addr := range addrs {
 			ipnet, ok := addr.(*net.IPNet)
 			if !ok || ipnet.IP.IsLoopback() {
 				continue
 			}
-			ip := ipnet.IP.To4()
-			if ip == nil {
-				continue
+			if ip := ipnet.IP.To4(); ip != nil {
+				ips = append(ips, ip.String())
+			} else if !ipnet.IP.IsLinkLocalUnicast() {
+				ip6s = append(ip6s, ipnet.IP.String())
 			}
-			ips = append(ips, ip.String())
 		}
+		ips = append(ips, ip6s...)
 		if len(ips) > 0 {
 			m[iface.Name] = ips
 		}
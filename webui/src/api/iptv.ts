@@ -43,14 +43,52 @@ export const updateChannelGroups = (groups: ChannelGroup[]) => {
 	return axios.put('/api/channel-groups', groups);
 }
 
+// the unit of bitrate is bit per second, lag is the number of bytes waiting
+// to be sent, and ttfb is the time to first byte in millisecond
 export interface RelayClient {
 	addr: string;
+	userAgent?: string;
 	createdAt: string;
+	sent: number;
+	bitrate: number;
+	skipped: number;
+	skips: number;
+	lag: number;
+	ttfb: number;
+	drops: number;
+	downgraded: boolean;
+}
+
+export interface RTPStats {
+	received: number;
+	lost: number;
+	duplicated: number;
+	reordered: number;
+}
+
+// the unit of pcrJitter is microsecond
+export interface TSErrorStats {
+	packets: number;
+	ccErrors: number;
+	teiErrors: number;
+	syncErrors: number;
+	pcrErrors: number;
+	pcrJitter: number;
 }
 
 export interface RelayConnection {
 	addr: string;
 	createdAt: string;
+	received: number;
+	bitrate: number;
+	skipped: number;
+	skips: number;
+	ttfb: number;
+	stalls: number;
+	rtp?: RTPStats;
+	tsErrors: TSErrorStats;
+	idleSince?: string;
+	reused: number;
 	clients: RelayClient[];
 }
 
@@ -58,6 +96,50 @@ export const listRelayConnections = () => {
 	return axios.get<RelayConnection[]>('/api/relays').then(res => res.data);
 }
 
+export interface ElementaryStream {
+	pid: number;
+	streamType: number;
+	codec: string;
+	language?: string;
+}
+
+export interface Program {
+	number: number;
+	pmtPID: number;
+	pcrPID: number;
+	serviceName?: string;
+	providerName?: string;
+	streams: ElementaryStream[];
+}
+
+export interface StreamInfo {
+	transportStreamID: number;
+	programs: Program[];
+}
+
+export interface TSErrorRecord extends TSErrorStats {
+	time: string;
+}
+
+export const listTSErrorHistory = (source?: string) => {
+	return axios.get<Record<string, TSErrorRecord[]>>('/api/ts-errors', {params: {source}}).then(res => res.data);
+}
+
+export interface LingerStats {
+	linger: number;
+	started: number;
+	reused: number;
+	expired: number;
+}
+
+export const getLingerStats = () => {
+	return axios.get<LingerStats>('/api/relay-linger').then(res => res.data);
+}
+
+export const getRelayInfo = (addr: string) => {
+	return axios.get<StreamInfo>(`/api/relays/${addr}/info`).then(res => res.data);
+}
+
 export const dropRelayConnection = (addr: string) => {
 	return axios.delete(`/api/relays/${addr}`);
 }
@@ -66,6 +148,102 @@ export const dropRelayClient = (addr: string, clientAddr: string) => {
 	return axios.delete(`/api/relays/${addr}/${clientAddr}`);
 }
 
+export interface SourceHealth {
+	source: string;
+	channels: string[];
+	alive: boolean;
+	bitrate: number;
+	lastSeen: string;
+	checkedAt: string;
+}
+
+export const listSourceHealth = () => {
+	return axios.get<SourceHealth[]>('/api/source-health').then(res => res.data);
+}
+
+export interface ScanResult {
+	addr: string;
+	rtp: boolean;
+	serviceName?: string;
+	providerName?: string;
+}
+
+export interface Scan {
+	running: boolean;
+	startedAt: string;
+	total: number;
+	done: number;
+	results: ScanResult[];
+}
+
+export const startScan = (ranges: string[], timeout?: number) => {
+	return axios.post('/api/scan', {ranges, timeout});
+}
+
+export const getScan = () => {
+	return axios.get<Scan>('/api/scan').then(res => res.data);
+}
+
+export const cancelScan = () => {
+	return axios.delete('/api/scan');
+}
+
+export interface Recording {
+	id: string;
+	channel?: string;
+	addr?: string;
+	start: string;
+	duration: number;
+	status: string;
+	error?: string;
+	size: number;
+}
+
+export const listRecordings = () => {
+	return axios.get<Recording[]>('/api/recordings').then(res => res.data);
+}
+
+export const createRecording = (rec: {channel?: string, addr?: string, start?: Date, duration: number}) => {
+	return axios.post<Recording>('/api/recordings', rec).then(res => res.data);
+}
+
+export const recordingURL = (id: string) => `/api/recordings/${id}`;
+
+export const deleteRecording = (id: string) => {
+	return axios.delete(`/api/recordings/${id}`);
+}
+
+export interface Output {
+	id: string;
+	source: string;
+	dest: string;
+	iface?: string;
+	ttl?: number;
+	rtp?: boolean;
+}
+
+export interface OutputStatus extends Output {
+	status: string;
+	error?: string;
+	sent: number;
+}
+
+export const listOutputs = () => {
+	return axios.get<OutputStatus[]>('/api/outputs').then(res => res.data);
+}
+
+export const createOutput = (out: Omit<Output, 'id'>) => {
+	return axios.post<Output>('/api/outputs', out).then(res => res.data);
+}
+
+export const updateOutput = (out: Output) => {
+	return axios.put(`/api/outputs/${out.id}`, out);
+}
+
+export const deleteOutput = (id: string) => {
+	return axios.delete(`/api/outputs/${id}`);
+}
+
 export interface Programme {
 	title: string;
 	start: Date;
@@ -95,8 +273,31 @@ export interface Config {
 	epgURL: string;
 	mcastIface: string;
 	mcastPacketSize: number;
+	mcastBatchSize: number;
+	mcastRecvBuffer: number;
 	writeBufferSize: number;
 	readTimeout: number;
+	sourceTimeout: number;
+	rtspTransport: string;
+	fileSourceDir: string;
+	rtpReorderWindow: number;
+	relayLinger: number;
+	maxGroups: number;
+	maxBandwidth: number;
+	maxGroupClients: number;
+	clientWriteTimeout: number;
+	stallPolicy: 'drop' | 'disconnect' | 'downgrade';
+	stallDrops: number;
+	relayBufferSize: number;
+	gopCacheSize: number;
+	healthCheckInterval: number;
+	healthCheckDuration: number;
+	recordingDir: string;
+	timeshiftAddrs?: string[];
+	timeshiftDuration: number;
+	timeshiftDir: string;
+	hlsSegmentDuration: number;
+	hlsPlaylistSize: number;
 }
 
 export const getConfig = () => {
@@ -7,7 +7,7 @@ const routes: RouteRecordRaw[] = [
   { path: '/', redirect: '/watch' },
   { path: '/watch', component: () => import('./views/WatchView.vue') },
   { path: '/channel', component: () => import('./views/ChannelView.vue') },
-  { path: '/status', component: () => import('./views/StatusView.vue') },
+  { path: '/monitor', component: () => import('./views/StatusView.vue') },
   { path: '/config', component: () => import('./views/ConfigView.vue') },
   { path: '/about', component: () => import('./views/AboutView.vue') },
   { path: '/:pathMatch(.*)', component: () => import('./views/NotFound.vue') },